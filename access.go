@@ -0,0 +1,60 @@
+package pp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Access rules make up the allowlist of users that are allowed to log in.
+// A rule is one of the following:
+//
+//   user@example.com  the user with exactly this ID (email)
+//   @example.com      every user whose email is in the domain example.com
+//   hd:example.com    every user whose hosted domain (e.g. Google Workspace) is example.com
+//
+// Rules are case insensitive.
+
+const accessRuleHostedDomainPrefix = "hd:"
+
+// NormalizeAccessRule validates the rule and returns it in its canonical (lower case) form.
+func NormalizeAccessRule(rule string) (string, error) {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+
+	switch {
+	case strings.HasPrefix(rule, accessRuleHostedDomainPrefix):
+		if len(rule) == len(accessRuleHostedDomainPrefix) || strings.Contains(rule, "@") {
+			return "", fmt.Errorf("invalid hosted domain rule %q", rule)
+		}
+
+	case strings.HasPrefix(rule, "@"):
+		if len(rule) == 1 || strings.Count(rule, "@") != 1 {
+			return "", fmt.Errorf("invalid domain rule %q", rule)
+		}
+
+	default:
+		i := strings.Index(rule, "@")
+		if i <= 0 || i == len(rule)-1 || strings.Count(rule, "@") != 1 {
+			return "", fmt.Errorf("invalid email rule %q", rule)
+		}
+	}
+
+	return rule, nil
+}
+
+// MatchAccessRule returns true if the user with the given ID and hosted domain
+// is allowed by the rule, the rule must be normalized.
+func MatchAccessRule(rule, userID, hostedDomain string) bool {
+	userID = strings.ToLower(userID)
+	hostedDomain = strings.ToLower(hostedDomain)
+
+	switch {
+	case strings.HasPrefix(rule, accessRuleHostedDomainPrefix):
+		return hostedDomain != "" && hostedDomain == rule[len(accessRuleHostedDomainPrefix):]
+
+	case strings.HasPrefix(rule, "@"):
+		return strings.HasSuffix(userID, rule) && strings.Count(userID, "@") == 1
+
+	default:
+		return userID == rule
+	}
+}
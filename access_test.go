@@ -0,0 +1,41 @@
+package pp_test
+
+import (
+	"testing"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeAccessRule(t *testing.T) {
+	assert := assert.New(t)
+
+	for rule, expected := range map[string]string{
+		"Alice@Example.com": "alice@example.com",
+		" @example.com ":    "@example.com",
+		"hd:Example.com":    "hd:example.com",
+	} {
+		got, err := pp.NormalizeAccessRule(rule)
+		assert.NoError(err, rule)
+		assert.Equal(expected, got)
+	}
+
+	for _, rule := range []string{"", "@", "alice", "alice@", "@a@example.com", "hd:", "hd:alice@example.com"} {
+		_, err := pp.NormalizeAccessRule(rule)
+		assert.Error(err, rule)
+	}
+}
+
+func TestMatchAccessRule(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(pp.MatchAccessRule("alice@example.com", "Alice@example.com", ""))
+	assert.False(pp.MatchAccessRule("alice@example.com", "bob@example.com", ""))
+
+	assert.True(pp.MatchAccessRule("@example.com", "bob@example.com", ""))
+	assert.False(pp.MatchAccessRule("@example.com", "bob@notexample.com", ""))
+	assert.False(pp.MatchAccessRule("@example.com", "bob@sub.example.com", ""))
+
+	assert.True(pp.MatchAccessRule("hd:example.com", "bob@gmail.com", "example.com"))
+	assert.False(pp.MatchAccessRule("hd:example.com", "bob@example.com", ""))
+}
@@ -1,7 +1,50 @@
 package pp
 
-import "net/http"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/oauth2"
+)
+
+// Identity is the identity of a user as returned by an Auth provider.
+type Identity struct {
+	UserID string
+	// HostedDomain is the domain of the organization (e.g. a Google Workspace)
+	// the user belongs to, it's empty if the provider doesn't tell it.
+	HostedDomain string
+}
 
 type Auth interface {
-	HandleAuth(http.ResponseWriter, *http.Request, Storage, bool) error
+	// AuthURL returns the URL of the provider the user should be redirected to
+	// for logging in, codeChallenge is the PKCE (S256) challenge of the login.
+	AuthURL(state, codeChallenge string) string
+	// Identify exchanges the code the provider returned to the identity of the
+	// user, codeVerifier is the PKCE verifier of the challenge given to AuthURL.
+	Identify(ctx context.Context, code, codeVerifier string) (Identity, error)
+}
+
+// GeneratePKCE generates a new PKCE code verifier and its S256 code challenge.
+func GeneratePKCE() (string, string) {
+	// GenerateSecret returns 48 characters of URL safe base64 without padding,
+	// which is a valid code verifier
+	verifier := GenerateSecret()
+	hash := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// pkceAuthCodeOptions returns the options that add the PKCE challenge to the auth code URL.
+func pkceAuthCodeOptions(codeChallenge string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// pkceExchangeOptions returns the options that add the PKCE verifier to the token exchange.
+func pkceExchangeOptions(codeVerifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_verifier", codeVerifier),
+	}
 }
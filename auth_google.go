@@ -1,10 +1,9 @@
 package pp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -12,6 +11,10 @@ import (
 
 type googleUserinfo struct {
 	Email string
+	// VerifiedEmail is false if the user hasn't confirmed they own the email
+	VerifiedEmail bool `json:"verified_email"`
+	// Hd is the hosted domain (Google Workspace) of the user
+	Hd string
 }
 
 type AuthGoogle struct {
@@ -30,28 +33,21 @@ func NewAuthGoogle(clientID, clientSecret, authURL string) AuthGoogle {
 	}}
 }
 
-func (a AuthGoogle) HandleAuth(w http.ResponseWriter, r *http.Request, storage Storage, noSecureCookie bool) error {
-	q := r.URL.Query()
-	code := q.Get("code")
-
-	if code == "" {
-		log.Printf("auth code is not set, redirecting user to authentication")
-		url := a.oauth.AuthCodeURL("state")
-		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-		return nil
-	}
+func (a AuthGoogle) AuthURL(state, codeChallenge string) string {
+	return a.oauth.AuthCodeURL(state, pkceAuthCodeOptions(codeChallenge)...)
+}
 
-	log.Print("exchanging auth code")
+func (a AuthGoogle) Identify(ctx context.Context, code, codeVerifier string) (Identity, error) {
 
-	tok, err := a.oauth.Exchange(r.Context(), code)
+	tok, err := a.oauth.Exchange(ctx, code, pkceExchangeOptions(codeVerifier)...)
 	if err != nil {
-		return fmt.Errorf("failed to exchange token: %v", err)
+		return Identity{}, fmt.Errorf("failed to exchange token: %v", err)
 	}
 
-	client := a.oauth.Client(r.Context(), tok)
+	client := a.oauth.Client(ctx, tok)
 	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
 	if err != nil {
-		return fmt.Errorf("failed to get email: %v", err)
+		return Identity{}, fmt.Errorf("failed to get email: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -59,23 +55,17 @@ func (a AuthGoogle) HandleAuth(w http.ResponseWriter, r *http.Request, storage S
 	userinfo := googleUserinfo{}
 	err = jDecoder.Decode(&userinfo)
 	if err != nil {
-		return fmt.Errorf("failed to parse JSON returned by Google: %v", err)
+		return Identity{}, fmt.Errorf("failed to parse JSON returned by Google: %v", err)
 	}
 
-	email := userinfo.Email
-	secret, err := storage.CreateUser(email)
-	if err != nil {
-		return fmt.Errorf("failed to create a user: %v", err)
+	if userinfo.Email == "" {
+		return Identity{}, fmt.Errorf("Google did not return an email")
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "podcast_session",
-		Value:    secret,
-		Secure:   !noSecureCookie,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	// like with OIDC, an email that isn't verified could match a domain rule
+	if !userinfo.VerifiedEmail {
+		return Identity{}, fmt.Errorf("the email %v is not verified by Google", userinfo.Email)
+	}
 
-	return nil
+	return Identity{userinfo.Email, userinfo.Hd}, nil
 }
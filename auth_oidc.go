@@ -0,0 +1,112 @@
+package pp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// AuthOIDC authenticates users with any OpenID Connect provider (e.g. Keycloak,
+// Okta, Azure AD or Authentik), the endpoints of the provider are found with
+// OIDC discovery and the ID tokens are verified against the keys of the provider.
+type AuthOIDC struct {
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	userClaim         string
+	hostedDomainClaim string
+	// allowUnverifiedEmail accepts emails without email_verified, for the
+	// providers that only have verified emails but don't send the claim
+	allowUnverifiedEmail bool
+}
+
+// NewAuthOIDC discovers the provider at issuer, userClaim is the claim of the
+// ID token that is used as the ID of the user (e.g. email or sub) and
+// hostedDomainClaim is the (optional) claim that contains the hosted domain of the user.
+// If the user claim is email the email must be verified (email_verified is true),
+// unless allowUnverifiedEmail is set.
+func NewAuthOIDC(ctx context.Context, issuer, clientID, clientSecret, authURL string, scopes []string, userClaim, hostedDomainClaim string, allowUnverifiedEmail bool) (AuthOIDC, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return AuthOIDC{}, fmt.Errorf("failed to discover OIDC provider %q: %v", issuer, err)
+	}
+
+	if userClaim == "" {
+		return AuthOIDC{}, errors.New("the user claim must be set")
+	}
+
+	hasOpenID := false
+	for _, scope := range scopes {
+		hasOpenID = hasOpenID || scope == oidc.ScopeOpenID
+	}
+	if !hasOpenID {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	return AuthOIDC{
+		oauth: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  authURL,
+			Scopes:       scopes,
+			Endpoint:     provider.Endpoint(),
+		},
+		verifier:             provider.Verifier(&oidc.Config{ClientID: clientID}),
+		userClaim:            userClaim,
+		hostedDomainClaim:    hostedDomainClaim,
+		allowUnverifiedEmail: allowUnverifiedEmail,
+	}, nil
+}
+
+func (a AuthOIDC) AuthURL(state, codeChallenge string) string {
+	return a.oauth.AuthCodeURL(state, pkceAuthCodeOptions(codeChallenge)...)
+}
+
+func (a AuthOIDC) Identify(ctx context.Context, code, codeVerifier string) (Identity, error) {
+
+	tok, err := a.oauth.Exchange(ctx, code, pkceExchangeOptions(codeVerifier)...)
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to exchange token: %v", err)
+	}
+
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("the token response did not contain an ID token")
+	}
+
+	idToken, err := a.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to verify ID token: %v", err)
+	}
+
+	claims := make(map[string]interface{})
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to parse the claims of the ID token: %v", err)
+	}
+
+	userID, ok := claims[a.userClaim].(string)
+	if !ok || userID == "" {
+		return Identity{}, fmt.Errorf("the ID token does not have a string claim %q", a.userClaim)
+	}
+
+	// emails are only trusted if the provider has verified them, otherwise
+	// anyone could sign up with someone else's email. A missing claim isn't
+	// trusted either. Some providers send the claim as a string.
+	if a.userClaim == "email" && !a.allowUnverifiedEmail {
+		verified := claims["email_verified"]
+		if verified != true && verified != "true" {
+			return Identity{}, fmt.Errorf("the email %q has not been verified by the provider (email_verified is %v)", userID, verified)
+		}
+	}
+
+	var hostedDomain string
+	if a.hostedDomainClaim != "" {
+		hostedDomain, _ = claims[a.hostedDomainClaim].(string)
+	}
+
+	return Identity{userID, hostedDomain}, nil
+}
@@ -0,0 +1,143 @@
+package pp_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// stubIssuer is a minimal OpenID Connect provider, every code it receives on
+// the token endpoint is exchanged to an ID token with the claims in claims.
+type stubIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	// codeVerifier is the PKCE verifier of the last token request
+	codeVerifier string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                s.server.URL,
+			"authorization_endpoint":                s.server.URL + "/authorize",
+			"token_endpoint":                        s.server.URL + "/token",
+			"jwks_uri":                              s.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &s.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		s.codeVerifier = r.FormValue("code_verifier")
+
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.RS256, Key: s.key},
+			(&jose.SignerOptions{}).WithHeader("kid", "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, _ := json.Marshal(s.claims)
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idToken, _ := jws.CompactSerialize()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+func (s *stubIssuer) setClaims(claims map[string]interface{}) {
+	s.claims = map[string]interface{}{
+		"iss": s.server.URL,
+		"aud": "client",
+		"sub": "1234",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		s.claims[k] = v
+	}
+}
+
+func TestAuthOIDC(t *testing.T) {
+	assert := assert.New(t)
+
+	issuer := newStubIssuer(t)
+	defer issuer.server.Close()
+
+	ctx := context.Background()
+	a, err := pp.NewAuthOIDC(ctx, issuer.server.URL, "client", "secret", "http://localhost/auth", []string{"email"}, "email", "hd", false)
+	assert.NoError(err)
+
+	verifier, challenge := pp.GeneratePKCE()
+
+	u, err := url.Parse(a.AuthURL("state", challenge))
+	assert.NoError(err)
+	assert.Equal(issuer.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal("openid email", u.Query().Get("scope"))
+	assert.Equal("state", u.Query().Get("state"))
+	assert.Equal(challenge, u.Query().Get("code_challenge"))
+	assert.Equal("S256", u.Query().Get("code_challenge_method"))
+
+	issuer.setClaims(map[string]interface{}{"email": "alice@example.com", "email_verified": true, "hd": "example.com"})
+	identity, err := a.Identify(ctx, "code", verifier)
+	assert.NoError(err)
+	assert.Equal(pp.Identity{UserID: "alice@example.com", HostedDomain: "example.com"}, identity)
+	assert.Equal(verifier, issuer.codeVerifier)
+
+	issuer.setClaims(map[string]interface{}{"email": "alice@example.com", "email_verified": false})
+	_, err = a.Identify(ctx, "code", verifier)
+	assert.Error(err)
+
+	// a missing email_verified isn't trusted either, unless it's allowed
+	issuer.setClaims(map[string]interface{}{"email": "alice@example.com"})
+	_, err = a.Identify(ctx, "code", verifier)
+	assert.Error(err)
+
+	unverified, err := pp.NewAuthOIDC(ctx, issuer.server.URL, "client", "secret", "http://localhost/auth", nil, "email", "", true)
+	assert.NoError(err)
+	identity, err = unverified.Identify(ctx, "code", verifier)
+	assert.NoError(err)
+	assert.Equal("alice@example.com", identity.UserID)
+
+	issuer.setClaims(map[string]interface{}{"email": "alice@example.com", "email_verified": true, "aud": "another-client"})
+	_, err = a.Identify(ctx, "code", verifier)
+	assert.Error(err)
+
+	issuer.setClaims(map[string]interface{}{})
+	_, err = a.Identify(ctx, "code", verifier)
+	assert.Error(err)
+}
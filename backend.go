@@ -1,9 +1,94 @@
 package pp
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
 
 type Backend interface {
 	GetLogo() (io.ReadCloser, error)
 	ListPodcasts() ([]Podcast, error)
 	GetPodcast(key string) (Podcast, error)
+	// GetFile returns the content of another file of the backend, such as the
+	// artwork of an episode. The key is relative to the prefix like the logo.
+	GetFile(key string) (io.ReadCloser, error)
+}
+
+// Validator is implemented by the backends that can check their files for
+// mistakes, such as files that are silently skipped by ListPodcasts.
+type Validator interface {
+	// Validate returns a description of every problem found, the backend is
+	// fine if none are returned.
+	Validate() ([]string, error)
+}
+
+// validateKeys returns the problems with the keys (file names) of a backend
+// that has the given logo.
+func validateKeys(keys []string, logo string) []string {
+	exists := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		exists[key] = true
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	if !exists[logo] {
+		problems = append(problems, fmt.Sprintf("%v: the logo does not exist", logo))
+	}
+
+	for _, key := range keys {
+		switch {
+		case key == logo:
+
+		case isEpisode(key):
+			if _, _, err := splitTitle(key, time.UTC); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v, the podcast is skipped", key, err))
+			}
+
+		case strings.HasSuffix(key, ".txt") && isEpisode(strings.TrimSuffix(key, ".txt")):
+			if !exists[strings.TrimSuffix(key, ".txt")] {
+				problems = append(problems, fmt.Sprintf("%v: description of a podcast that does not exist", key))
+			}
+
+		case isSidecar(key):
+			podcast := key[:strings.LastIndex(key, ".")]
+			if !exists[podcast] {
+				problems = append(problems, fmt.Sprintf("%v: sidecar of a podcast that does not exist", key))
+			} else if sidecar := sidecarKey(podcast, func(k string) bool { return exists[k] }); sidecar != key {
+				problems = append(problems, fmt.Sprintf("%v: the podcast already has the sidecar %v, the file is ignored", key, sidecar))
+			}
+
+		case isChapters(key):
+			if !exists[strings.TrimSuffix(key, chaptersSuffix)] {
+				problems = append(problems, fmt.Sprintf("%v: chapters of a podcast that does not exist", key))
+			}
+
+		case transcriptPodcast(key) != "":
+			if !exists[transcriptPodcast(key)] {
+				problems = append(problems, fmt.Sprintf("%v: transcript of a podcast that does not exist", key))
+			}
+
+		case isImage(key):
+			// images are used as the artwork of episodes
+
+		default:
+			problems = append(problems, fmt.Sprintf("%v: not a podcast (%v), a description (.mp3.txt), a sidecar (.mp3.json), chapters (.mp3.chapters.json), a transcript (.mp3.vtt, .mp3.srt, .mp3.transcript.txt) or an image, the file is ignored", key, episodeExtensions()))
+		}
+	}
+
+	return problems
+}
+
+// isImage returns true if the key is an image, which can be the artwork of an
+// episode.
+func isImage(key string) bool {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
 }
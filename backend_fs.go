@@ -0,0 +1,185 @@
+package pp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackendFS serves podcasts from a local directory, it follows the exact same
+// conventions as BackendS3 (the files in the directory are the objects in the bucket).
+type BackendFS struct {
+	dir     string
+	logo    string
+	catalog *Catalog
+	log     Logger
+	loc     *time.Location
+}
+
+// NewBackendFS creates a backend that serves the podcasts in dir, the details of
+// the podcasts are cached in catalog, if it's nil an in-memory catalog is used.
+func NewBackendFS(dir, logo string, catalog *Catalog, logger Logger) BackendFS {
+	if catalog == nil {
+		catalog, _ = NewCatalog("", logger)
+	}
+
+	return BackendFS{dir, logo, catalog, logger.With("dir", dir), time.UTC}
+}
+
+// WithLocation returns the backend with loc as the timezone of the published
+// dates (and times) of the keys and sidecars that don't have their own.
+func (b BackendFS) WithLocation(loc *time.Location) BackendFS {
+	b.loc = loc
+	return b
+}
+
+// fileVersion returns a string that changes whenever the file changes, info
+// can be nil in which case the file doesn't exist.
+func fileVersion(info os.FileInfo) string {
+	if info == nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%v/%v", info.ModTime().UTC().Format(time.RFC3339Nano), info.Size())
+}
+
+// path returns the path of key inside of the backend directory, keys that would
+// point outside of the directory (or into a subdirectory) are rejected.
+func (b BackendFS) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	return filepath.Join(b.dir, key), nil
+}
+
+func (b BackendFS) GetLogo() (io.ReadCloser, error) {
+	path, err := b.path(b.logo)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (b BackendFS) ListPodcasts() ([]Podcast, error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]os.FileInfo, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			files[info.Name()] = info
+		}
+	}
+
+	out := make([]Podcast, 0, len(infos))
+	keys := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		key := info.Name()
+		if !isEpisode(key) {
+			b.log.Debug("skipping file that is not an episode", "key", key)
+			continue
+		}
+
+		exists := func(k string) bool { return files[k] != nil }
+		sidecar := sidecarKey(key, exists)
+		version := fileVersion(info) + " " + fileVersion(files[key+".txt"]) + " " + sidecar + "@" + fileVersion(files[sidecar]) + " " + fileVersion(files[key+chaptersSuffix]) + " " + transcriptsVersion(key, exists) + " " + b.loc.String()
+
+		keys[key] = true
+		guid := b.catalog.Identify(key, fileVersion(info), exists)
+		details, ok := b.catalog.Lookup(key, version)
+		if !ok {
+			var (
+				complete bool
+				err      error
+			)
+			details, complete, err = readPodcastFSDetails(&b, key, info, exists)
+			if err != nil {
+				b.log.Warn("invalid podcast", "key", key, "error", err)
+				continue
+			}
+			if complete {
+				b.catalog.Store(key, version, details)
+			}
+		}
+
+		if details.GUID == "" {
+			details.GUID = guid
+		}
+		out = append(out, PodcastFS{&b, details})
+	}
+
+	b.catalog.Retain(keys)
+	err = b.catalog.Save()
+	if err != nil {
+		b.log.Error("failed to save catalog", "error", err)
+	}
+
+	return out, nil
+}
+
+func (b BackendFS) GetPodcast(key string) (Podcast, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return PodcastFS{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return PodcastFS{}, err
+	}
+
+	details, _, err := readPodcastFSDetails(&b, key, info, func(k string) bool {
+		path, err := b.path(k)
+		if err != nil {
+			return false
+		}
+		info, err := os.Stat(path)
+		return err == nil && !info.IsDir()
+	})
+	if err != nil {
+		return PodcastFS{}, err
+	}
+	if details.GUID == "" {
+		// without the other files renames can't be detected here
+		details.GUID = b.catalog.Identify(key, fileVersion(info), func(string) bool { return true })
+	}
+
+	return PodcastFS{&b, details}, nil
+}
+
+func (b BackendFS) GetFile(key string) (io.ReadCloser, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (b BackendFS) Validate() ([]string, error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			keys = append(keys, info.Name())
+		}
+	}
+
+	return validateKeys(keys, b.logo), nil
+}
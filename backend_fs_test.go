@@ -0,0 +1,294 @@
+package pp_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "pp-backend-fs-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestBackendFSListPodcasts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"logo.png":                        "logo",
+		"2020-01-27 Hello World!.mp3":     "0123456789",
+		"2020-01-27 Hello World!.mp3.txt": "A description.",
+		"2020-02-01 Second.mp3":           "01234",
+		"not a podcast.mp3":               "invalid",
+		"notes.txt":                       "not a podcast",
+	})
+	defer os.RemoveAll(dir)
+
+	b := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{})
+
+	ps, err := b.ListPodcasts()
+	assert.NoError(err)
+	assert.Len(ps, 2)
+
+	details := map[string]pp.PodcastDetails{}
+	for _, p := range ps {
+		details[p.Details().Key] = p.Details()
+	}
+
+	hello := details["2020-01-27 Hello World!.mp3"]
+	assert.Equal("Hello World!", hello.Title)
+	assert.Equal("A description.", hello.Description)
+	assert.Equal(int64(10), hello.Size)
+	assert.Equal(time.Date(2020, 1, 27, 0, 0, 0, 0, time.UTC), hello.Published)
+
+	second := details["2020-02-01 Second.mp3"]
+	assert.Equal("Second", second.Title)
+	assert.Equal("", second.Description)
+
+	logo, err := b.GetLogo()
+	assert.NoError(err)
+	defer logo.Close()
+	data, err := ioutil.ReadAll(logo)
+	assert.NoError(err)
+	assert.Equal("logo", string(data))
+}
+
+func TestBackendFSFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Audio.m4a":     "m4a",
+		"2020-01-28 Opus.opus":     "opus",
+		"2020-01-29 Lossless.flac": "flac",
+		"2020-01-30 Video.MP4":     "mp4",
+		"2020-01-31 Document.pdf":  "not an episode",
+	})
+	defer os.RemoveAll(dir)
+
+	b := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{})
+	ps, err := b.ListPodcasts()
+	assert.NoError(err)
+
+	types := map[string]string{}
+	for _, p := range ps {
+		types[p.Details().Title] = p.Details().ContentType
+	}
+	assert.Equal(map[string]string{
+		"Audio":    "audio/mp4",
+		"Opus":     "audio/ogg",
+		"Lossless": "audio/flac",
+		"Video":    "video/mp4",
+	}, types)
+
+	p, err := b.GetPodcast("2020-01-30 Video.MP4")
+	assert.NoError(err)
+	w := httptest.NewRecorder()
+	assert.NoError(p.HandlePodcast(w, httptest.NewRequest(http.MethodGet, "/podcast", nil)))
+	assert.Equal("video/mp4", w.Header().Get("Content-Type"))
+}
+
+func TestBackendFSSidecar(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Hello World!.mp3":     "0123456789",
+		"2020-01-27 Hello World!.mp3.txt": "A description.",
+		"2020-01-27 Hello World!.mp3.yaml": `
+title: Hello, World!
+published: 2020-01-27 09:30
+timezone: Europe/Helsinki
+episode: 3
+season: 1
+explicit: true
+duration: "1:02:03"
+artwork: hello.jpg
+guid: hello-world
+`,
+		"2020-02-01 Invalid.mp3":      "01234",
+		"2020-02-01 Invalid.mp3.json": `{"titel": "typo"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	b := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{})
+
+	// the podcast with an invalid sidecar is skipped
+	ps, err := b.ListPodcasts()
+	assert.NoError(err)
+	if !assert.Len(ps, 1) {
+		return
+	}
+
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	assert.NoError(err)
+
+	hello := ps[0].Details()
+	assert.Equal("Hello, World!", hello.Title)
+	assert.Equal("A description.", hello.Description)
+	assert.True(time.Date(2020, 1, 27, 9, 30, 0, 0, helsinki).Equal(hello.Published))
+	assert.Equal(3, hello.Episode)
+	assert.Equal(1, hello.Season)
+	assert.True(hello.Explicit)
+	assert.Equal(time.Hour+2*time.Minute+3*time.Second, hello.Duration)
+	assert.Equal("hello.jpg", hello.Artwork)
+	assert.Equal("hello-world", hello.GUID)
+
+	p, err := b.GetPodcast("2020-01-27 Hello World!.mp3")
+	assert.NoError(err)
+	assert.Equal(hello, p.Details())
+}
+
+func TestBackendFSLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Date.mp3":      ".",
+		"2020-01-28T0930 Time.mp3": ".",
+		"2020-01-29 Expires.mp3":   ".",
+		"2020-01-29 Expires.mp3.yaml": `
+published: 2020-01-29 18:00
+expires: 2020-02-29T12:00:00Z
+`,
+		"2020-01-30 Invalid.mp3":      ".",
+		"2020-01-30 Invalid.mp3.yaml": "expires: 2020-01-01",
+	})
+	defer os.RemoveAll(dir)
+
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	assert.NoError(err)
+
+	// the podcast that expires before it's published is skipped
+	ps, err := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{}).WithLocation(helsinki).ListPodcasts()
+	assert.NoError(err)
+	details := map[string]pp.PodcastDetails{}
+	for _, p := range ps {
+		details[p.Details().Key] = p.Details()
+	}
+	assert.Len(details, 3)
+
+	assert.True(time.Date(2020, 1, 27, 0, 0, 0, 0, helsinki).Equal(details["2020-01-27 Date.mp3"].Published))
+	assert.True(time.Date(2020, 1, 28, 9, 30, 0, 0, helsinki).Equal(details["2020-01-28T0930 Time.mp3"].Published))
+	assert.Equal("Time", details["2020-01-28T0930 Time.mp3"].Title)
+	assert.True(details["2020-01-28T0930 Time.mp3"].Expires.IsZero())
+
+	expires := details["2020-01-29 Expires.mp3"]
+	assert.True(time.Date(2020, 1, 29, 18, 0, 0, 0, helsinki).Equal(expires.Published))
+	assert.True(time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC).Equal(expires.Expires))
+}
+
+func TestBackendFSGetPodcastInvalidKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, nil)
+	defer os.RemoveAll(dir)
+
+	b := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{})
+
+	for _, key := range []string{"", "../2020-01-27 Escape.mp3", "sub/2020-01-27 Nested.mp3", "2020-01-27 Missing.mp3"} {
+		_, err := b.GetPodcast(key)
+		assert.Error(err, key)
+	}
+}
+
+func TestPodcastFSHandlePodcastRange(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Hello World!.mp3": "0123456789",
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{}).GetPodcast("2020-01-27 Hello World!.mp3")
+	assert.NoError(err)
+
+	r := httptest.NewRequest(http.MethodGet, "/podcast", nil)
+	w := httptest.NewRecorder()
+	assert.NoError(p.HandlePodcast(w, r))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("audio/mpeg", w.Header().Get("Content-Type"))
+	assert.Equal("bytes", w.Header().Get("Accept-Ranges"))
+	assert.Equal("0123456789", w.Body.String())
+
+	r = httptest.NewRequest(http.MethodGet, "/podcast", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w = httptest.NewRecorder()
+	assert.NoError(p.HandlePodcast(w, r))
+	assert.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal("bytes 2-5/10", w.Header().Get("Content-Range"))
+	assert.Equal("4", w.Header().Get("Content-Length"))
+	assert.Equal("2345", w.Body.String())
+}
+
+func TestBackendFSValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Hello World!.mp3":      "podcast",
+		"2020-01-27 Hello World!.mp3.txt":  "description",
+		"Hello World!.mp3":                 "no date",
+		"2020-01-28 Removed.mp3.txt":       "description of nothing",
+		"notes.md":                         "notes",
+		"2020-01-27 Hello World!.mp3.json": "{}",
+		"2020-01-27 Hello World!.mp3.yml":  "{}",
+		"2020-01-28 Removed.mp3.json":      "{}",
+		"cover.jpg":                        "artwork",
+	})
+	defer os.RemoveAll(dir)
+
+	problems, err := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{}).Validate()
+	assert.NoError(err)
+	if assert.Len(problems, 6) {
+		assert.Contains(problems[0], "logo.png")
+		assert.Contains(problems[1], "2020-01-27 Hello World!.mp3.yml")
+		assert.Contains(problems[2], "2020-01-28 Removed.mp3.json")
+		assert.Contains(problems[3], "2020-01-28 Removed.mp3.txt")
+		assert.Contains(problems[4], "Hello World!.mp3")
+		assert.Contains(problems[5], "notes.md")
+	}
+}
+
+func TestBackendFSTranscripts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Hello.mp3":                ".",
+		"2020-01-27 Hello.mp3.txt":            "The description, not a transcript.",
+		"2020-01-27 Hello.mp3.vtt":            "WEBVTT",
+		"2020-01-27 Hello.mp3.transcript.txt": "Hello.",
+		"2020-01-28 Orphan.mp3.srt":           "1",
+		"logo.png":                            "",
+	})
+	defer os.RemoveAll(dir)
+
+	b := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{})
+	ps, err := b.ListPodcasts()
+	assert.NoError(err)
+	if assert.Len(ps, 1) {
+		assert.Equal([]pp.Transcript{
+			{Key: "2020-01-27 Hello.mp3.vtt", ContentType: "text/vtt"},
+			{Key: "2020-01-27 Hello.mp3.transcript.txt", ContentType: "text/plain"},
+		}, ps[0].Details().Transcripts)
+		assert.Equal("The description, not a transcript.", ps[0].Details().Description)
+	}
+
+	problems, err := b.Validate()
+	assert.NoError(err)
+	assert.Equal([]string{"2020-01-28 Orphan.mp3.srt: transcript of a podcast that does not exist"}, problems)
+}
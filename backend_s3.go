@@ -2,9 +2,10 @@ package pp
 
 import (
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -12,20 +13,58 @@ import (
 )
 
 type BackendS3 struct {
-	s3     *s3.S3
-	bucket string
-	logo   string
+	s3      *s3.S3
+	bucket  string
+	prefix  string
+	logo    string
+	catalog *Catalog
+	log     Logger
+	loc     *time.Location
 }
 
-func NewBackendS3(bucket, logo string) BackendS3 {
+// NewBackendS3 creates a backend that serves the podcasts in bucket whose keys
+// start with prefix, the prefix can be empty to use the whole bucket.
+// The logo key is relative to the prefix. The details of the podcasts are
+// cached in catalog, if it's nil an in-memory catalog is used.
+func NewBackendS3(bucket, prefix, logo string, catalog *Catalog, logger Logger) BackendS3 {
+	if catalog == nil {
+		catalog, _ = NewCatalog("", logger)
+	}
+
 	session := session.Must(session.NewSession())
-	return BackendS3{s3.New(session), bucket, logo}
+	return BackendS3{s3.New(session), bucket, prefix, logo, catalog, logger.With("bucket", bucket, "prefix", prefix), time.UTC}
+}
+
+// WithLocation returns the backend with loc as the timezone of the published
+// dates (and times) of the keys and sidecars that don't have their own.
+func (b BackendS3) WithLocation(loc *time.Location) BackendS3 {
+	b.loc = loc
+	return b
+}
+
+// objectVersion returns a string that changes whenever the object changes, obj
+// can be nil in which case the object doesn't exist.
+func objectVersion(obj *s3.Object) string {
+	if obj == nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%v@%v/%v",
+		aws.StringValue(obj.ETag),
+		aws.TimeValue(obj.LastModified).UTC().Format(time.RFC3339Nano),
+		aws.Int64Value(obj.Size))
+}
+
+// objectFingerprint returns a string that identifies the content of an object,
+// unlike objectVersion it stays the same when the object is copied (renamed).
+func objectFingerprint(etag *string, size *int64) string {
+	return fmt.Sprintf("%v/%v", aws.StringValue(etag), aws.Int64Value(size))
 }
 
 func (b BackendS3) GetLogo() (io.ReadCloser, error) {
 	p, err := b.s3.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(b.bucket),
-		Key:    aws.String(b.logo),
+		Key:    aws.String(b.prefix + b.logo),
 	})
 	if err != nil {
 		return nil, err
@@ -35,71 +74,80 @@ func (b BackendS3) GetLogo() (io.ReadCloser, error) {
 }
 
 func (b BackendS3) ListPodcasts() ([]Podcast, error) {
-	r, err := b.s3.ListObjects(&s3.ListObjectsInput{
+	var contents []*s3.Object
+
+	// ListObjectsPages takes care of following the markers of truncated responses
+	err := b.s3.ListObjectsPages(&s3.ListObjectsInput{
 		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		contents = append(contents, page.Contents...)
+		return true
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	contents := r.Contents
-
-	// the S3 API is kinda annoying and we have to jump through some hoops to
-	// make sure we get all of the objects, the go API for this is also not particularly great
-
-	var (
-		isTruncated bool
-		nextMarker  string
-	)
-
-	for {
-		if r.IsTruncated != nil {
-			isTruncated = *r.IsTruncated
-		}
-		if r.NextMarker != nil {
-			nextMarker = *r.NextMarker
-		} else {
-			isTruncated = false
-		}
-
-		if !isTruncated {
-			break
-		}
-
-		r, err = b.s3.ListObjects(&s3.ListObjectsInput{
-			Marker: &nextMarker,
-		})
-		if err != nil {
-			return nil, err
-		}
-		contents = append(contents, r.Contents...)
-	}
-
-	out := make([]Podcast, 0, len(contents))
+	objects := make(map[string]*s3.Object, len(contents))
 	for _, obj := range contents {
 		if obj.Key == nil {
 			return nil, errors.New("invalid S3 object: Key is nil")
 		}
+		objects[*obj.Key] = obj
+	}
 
+	out := make([]Podcast, 0, len(contents))
+	keys := make(map[string]bool, len(contents))
+	for _, obj := range contents {
 		key := *obj.Key
-		if !strings.HasSuffix(key, ".mp3") {
-			log.Printf("skipping non-MP3 file: %v", key)
+		if !isEpisode(key) {
+			b.log.Debug("skipping file that is not an episode", "key", key)
 			continue
 		}
 
-		p, err := newPodcastS3(&b, key, obj.Size)
-		if err != nil {
-			log.Printf("invalid podcast: %v", err)
-			continue
+		// the podcast has to be fetched again if either the podcast itself or
+		// one of its other files (e.g. the description) has changed
+		exists := func(k string) bool { return objects[k] != nil }
+		sidecar := sidecarKey(key, exists)
+		version := objectVersion(obj) + " " + objectVersion(objects[key+".txt"]) + " " + sidecar + "@" + objectVersion(objects[sidecar]) + " " + objectVersion(objects[key+chaptersSuffix]) + " " + transcriptsVersion(key, exists) + " " + b.loc.String()
+
+		keys[key] = true
+		guid := b.catalog.Identify(key, objectFingerprint(obj.ETag, obj.Size), exists)
+		details, ok := b.catalog.Lookup(key, version)
+		if !ok {
+			var (
+				complete bool
+				err      error
+			)
+			details, complete, err = fetchPodcastS3Details(&b, key, obj.Size, exists)
+			if err != nil {
+				b.log.Warn("invalid podcast", "key", key, "error", err)
+				continue
+			}
+			if complete {
+				b.catalog.Store(key, version, details)
+			}
 		}
-		out = append(out, p)
+
+		if details.GUID == "" {
+			details.GUID = guid
+		}
+		out = append(out, PodcastS3{&b, details})
+	}
+
+	b.catalog.Retain(keys)
+	err = b.catalog.Save()
+	if err != nil {
+		b.log.Error("failed to save catalog", "error", err)
 	}
 
 	return out, nil
 }
 
+// GetPodcast always fetches the details of the podcast from S3, the catalog is
+// only used by ListPodcasts.
 func (b BackendS3) GetPodcast(key string) (Podcast, error) {
-	p, err := b.s3.GetObject(&s3.GetObjectInput{
+	head, err := b.s3.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(b.bucket),
 		Key:    aws.String(key),
 	})
@@ -107,5 +155,61 @@ func (b BackendS3) GetPodcast(key string) (Podcast, error) {
 		return PodcastS3{}, err
 	}
 
-	return newPodcastS3(&b, key, p.ContentLength)
+	// the objects that start with the key tell which of the other files
+	// (e.g. the description) the podcast has
+	related := make(map[string]bool)
+	err = b.s3.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			related[aws.StringValue(obj.Key)] = true
+		}
+		return true
+	})
+	if err != nil {
+		return PodcastS3{}, err
+	}
+	details, _, err := fetchPodcastS3Details(&b, key, head.ContentLength, func(k string) bool { return related[k] })
+	if err != nil {
+		return PodcastS3{}, err
+	}
+	if details.GUID == "" {
+		// without the other objects renames can't be detected here
+		details.GUID = b.catalog.Identify(key, objectFingerprint(head.ETag, head.ContentLength), func(string) bool { return true })
+	}
+
+	return PodcastS3{&b, details}, nil
+}
+
+func (b BackendS3) GetFile(key string) (io.ReadCloser, error) {
+	obj, err := b.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.Body, nil
+}
+
+func (b BackendS3) Validate() ([]string, error) {
+	var keys []string
+	err := b.s3.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj.Key != nil {
+				keys = append(keys, strings.TrimPrefix(*obj.Key, b.prefix))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return validateKeys(keys, b.logo), nil
 }
@@ -0,0 +1,236 @@
+package pp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// catalogFormat is the version of the format of the cached details, it should
+// be bumped whenever the way the details of episodes are fetched changes, this
+// way old (possibly incomplete) entries are thrown away instead of being used.
+// The identities are kept regardless of the format, they can't be fetched again.
+const catalogFormat = 4
+
+type catalogEntry struct {
+	Version string         `json:"version"`
+	Details PodcastDetails `json:"details"`
+}
+
+// catalogIdentity is the identity of an episode: its GUID is kept when the
+// details change and moves with the episode when it's renamed (see Identify).
+// Fingerprint identifies the content of the episode for detecting the renames.
+type catalogIdentity struct {
+	GUID        string `json:"guid"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// catalogFile is the persisted catalog. The entries are only decoded if the
+// format matches. Before the identities had their own map they were part of
+// the entries, with the same field names as catalogIdentity.
+type catalogFile struct {
+	Format     int                        `json:"format"`
+	Entries    map[string]json.RawMessage `json:"entries"`
+	Identities map[string]catalogIdentity `json:"identities"`
+}
+
+// Catalog caches the details of episodes so that they only have to be fetched
+// from the backend when the episode (or one of the files that belong to it) changes.
+// The version of an entry is an opaque string decided by the backend, e.g.
+// the ETags of the objects that make up the episode.
+//
+// A catalog with a path is persisted to that file by Save, so that a restart
+// doesn't have to fetch the details of all episodes again.
+type Catalog struct {
+	path string
+	log  Logger
+
+	mutex      sync.Mutex
+	entries    map[string]catalogEntry
+	identities map[string]catalogIdentity
+	dirty      bool
+}
+
+// NewCatalog creates a catalog that is persisted at path, if the file exists its
+// entries are loaded. If path is empty the catalog only lives in memory.
+func NewCatalog(path string, logger Logger) (*Catalog, error) {
+	c := &Catalog{path: path, log: logger, entries: make(map[string]catalogEntry), identities: make(map[string]catalogIdentity)}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	var f catalogFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse catalog %q: %v", path, err)
+	}
+
+	if f.Identities != nil {
+		c.identities = f.Identities
+	} else {
+		for key, raw := range f.Entries {
+			var id catalogIdentity
+			if json.Unmarshal(raw, &id) == nil && id.GUID != "" {
+				c.identities[key] = id
+				c.dirty = true
+			}
+		}
+	}
+
+	if f.Format != catalogFormat {
+		c.log.Warn("the catalog has an old format, ignoring its entries", "path", path, "format", f.Format, "expected", catalogFormat)
+		c.dirty = true
+	} else {
+		for key, raw := range f.Entries {
+			var e catalogEntry
+			err = json.Unmarshal(raw, &e)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse entry %q of catalog %q: %v", key, path, err)
+			}
+			c.entries[key] = e
+		}
+	}
+
+	c.log.Info("loaded the catalog", "path", path, "entries", len(c.entries), "identities", len(c.identities))
+	return c, nil
+}
+
+// Lookup returns the details of key if they were stored with the same version.
+func (c *Catalog) Lookup(key, version string) (PodcastDetails, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || e.Version != version {
+		return PodcastDetails{}, false
+	}
+
+	return e.Details, true
+}
+
+// Store stores the details of key with the given version.
+func (c *Catalog) Store(key, version string, details PodcastDetails) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[key] = catalogEntry{version, details}
+	c.dirty = true
+}
+
+// Identify returns the GUID of the episode with the key, the fingerprint
+// identifies the content of the episode (e.g. its ETag and size) and exists
+// tells if a key still exists in the backend.
+//
+// An episode keeps the GUID it got when it was first seen. If a new key has
+// the same fingerprint as an entry whose key no longer exists, the episode
+// was renamed and the new key takes over its GUID. Otherwise the GUID is
+// KeyGUID(key), so that the GUIDs are stable even without a persisted catalog.
+func (c *Catalog) Identify(key, fingerprint string, exists func(string) bool) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	id, ok := c.identities[key]
+	if ok {
+		if id.Fingerprint != fingerprint {
+			id.Fingerprint = fingerprint
+			c.identities[key] = id
+			c.dirty = true
+		}
+		return id.GUID
+	}
+
+	id = catalogIdentity{KeyGUID(key), fingerprint}
+	if fingerprint != "" {
+		for oldKey, old := range c.identities {
+			if old.Fingerprint == fingerprint && !exists(oldKey) {
+				c.log.Info("episode was renamed, keeping its GUID", "old_key", oldKey, "key", key, "guid", old.GUID)
+				id.GUID = old.GUID
+				// the old identity is removed so that its GUID is never taken twice
+				delete(c.identities, oldKey)
+				delete(c.entries, oldKey)
+				break
+			}
+		}
+	}
+
+	c.identities[key] = id
+	c.dirty = true
+	return id.GUID
+}
+
+// Retain removes all entries whose key is not in keys, this is used to forget
+// episodes that have been removed from the backend.
+func (c *Catalog) Retain(keys map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.entries {
+		if !keys[key] {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+	for key := range c.identities {
+		if !keys[key] {
+			delete(c.identities, key)
+			c.dirty = true
+		}
+	}
+}
+
+// Save writes the catalog to its file if it has changed since it was last saved.
+func (c *Catalog) Save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+
+	f := catalogFile{catalogFormat, make(map[string]json.RawMessage, len(c.entries)), c.identities}
+	for key, e := range c.entries {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		f.Entries[key] = raw
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first and then rename it over the old catalog,
+	// this way a crash never leaves a half written catalog behind
+	tmpFile, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to save catalog %q: %v", c.path, err)
+	}
+
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,159 @@
+package pp_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogPersist(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pp-catalog-*")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "catalog.json")
+
+	c, err := pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+
+	details := pp.PodcastDetails{
+		Key:       "2020-01-27 Hello World!.mp3",
+		Title:     "Hello World!",
+		Published: time.Date(2020, 1, 27, 0, 0, 0, 0, time.UTC),
+		Size:      10,
+	}
+	c.Store(details.Key, "v1", details)
+	c.Store("removed.mp3", "v1", pp.PodcastDetails{Key: "removed.mp3"})
+	c.Retain(map[string]bool{details.Key: true})
+	assert.NoError(c.Save())
+
+	c, err = pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+
+	got, ok := c.Lookup(details.Key, "v1")
+	assert.True(ok)
+	assert.Equal(details, got)
+
+	_, ok = c.Lookup(details.Key, "v2")
+	assert.False(ok)
+
+	_, ok = c.Lookup("removed.mp3", "v1")
+	assert.False(ok)
+}
+
+func TestBackendFSCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Hello World!.mp3":     "0123456789",
+		"2020-01-27 Hello World!.mp3.txt": "First description.",
+	})
+	defer os.RemoveAll(dir)
+
+	c, err := pp.NewCatalog("", pp.Logger{})
+	assert.NoError(err)
+	b := pp.NewBackendFS(dir, "logo.png", c, pp.Logger{})
+
+	ps, err := b.ListPodcasts()
+	assert.NoError(err)
+	assert.Len(ps, 1)
+	assert.Equal("First description.", ps[0].Details().Description)
+
+	// changing the description changes the version of the podcast
+	descriptionPath := filepath.Join(dir, "2020-01-27 Hello World!.mp3.txt")
+	assert.NoError(ioutil.WriteFile(descriptionPath, []byte("Second description."), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(descriptionPath, later, later))
+
+	ps, err = b.ListPodcasts()
+	assert.NoError(err)
+	assert.Len(ps, 1)
+	assert.Equal("Second description.", ps[0].Details().Description)
+}
+
+func TestBackendFSRenameKeepsGUID(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Hello World!.mp3": "0123456789",
+		"2020-02-01 Second.mp3":       "01234",
+	})
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "catalog.json")
+	c, err := pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+	b := pp.NewBackendFS(dir, "logo.png", c, pp.Logger{})
+
+	guids := func() map[string]string {
+		ps, err := b.ListPodcasts()
+		assert.NoError(err)
+		out := make(map[string]string)
+		for _, p := range ps {
+			out[p.Details().Key] = p.Details().GUID
+		}
+		return out
+	}
+
+	before := guids()
+	assert.Equal(pp.KeyGUID("2020-01-27 Hello World!.mp3"), before["2020-01-27 Hello World!.mp3"])
+	assert.NotEqual(before["2020-01-27 Hello World!.mp3"], before["2020-02-01 Second.mp3"])
+
+	// the GUID moves with the episode, also to the next instance of the catalog
+	assert.NoError(os.Rename(filepath.Join(dir, "2020-01-27 Hello World!.mp3"), filepath.Join(dir, "2020-01-27 Hello, World!.mp3")))
+	c, err = pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+	b = pp.NewBackendFS(dir, "logo.png", c, pp.Logger{})
+
+	after := guids()
+	assert.Len(after, 2)
+	assert.Equal(before["2020-01-27 Hello World!.mp3"], after["2020-01-27 Hello, World!.mp3"])
+	assert.Equal(before["2020-02-01 Second.mp3"], after["2020-02-01 Second.mp3"])
+}
+
+func TestCatalogFormatKeepsGUIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pp-catalog-*")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "catalog.json")
+	c, err := pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+	guid := c.Identify("2020-01-27 Hello.mp3", "fingerprint", func(string) bool { return true })
+	c.Store("2020-01-27 Hello.mp3", "v1", pp.PodcastDetails{Key: "2020-01-27 Hello.mp3"})
+	assert.NoError(c.Save())
+
+	// a catalog with another format loses its details but not its GUIDs
+	var f map[string]interface{}
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.NoError(json.Unmarshal(data, &f))
+	f["format"] = 1
+	data, err = json.Marshal(f)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(path, data, 0644))
+
+	c, err = pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+	_, ok := c.Lookup("2020-01-27 Hello.mp3", "v1")
+	assert.False(ok)
+	assert.Equal(guid, c.Identify("2020-01-27 Hello, World.mp3", "fingerprint", func(string) bool { return false }))
+
+	// before the GUIDs had their own map they were kept in the entries
+	assert.NoError(ioutil.WriteFile(path, []byte(`{"format": 3, "entries": {
+		"2020-01-27 Hello.mp3": {"version": "v1", "details": {}, "guid": "legacy-guid", "fingerprint": "fingerprint"}
+	}}`), 0644))
+	c, err = pp.NewCatalog(path, pp.Logger{})
+	assert.NoError(err)
+	assert.Equal("legacy-guid", c.Identify("2020-01-27 Hello, World.mp3", "fingerprint", func(string) bool { return false }))
+}
@@ -0,0 +1,172 @@
+package pp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Chapter is a chapter of an episode, read from the ID3 tags (CHAP frames) or
+// the chapters file of the episode.
+type Chapter struct {
+	Start time.Duration
+	// End is zero if the chapter ends where the next one starts
+	End   time.Duration
+	Title string
+	URL   string
+}
+
+// chaptersSuffix is the suffix of the chapters file of an episode, the key of
+// the file is the key of the episode with the suffix.
+const chaptersSuffix = ".chapters.json"
+
+// isChapters returns true if the key is the chapters file of an episode (which
+// might not exist).
+func isChapters(key string) bool {
+	return strings.HasSuffix(key, chaptersSuffix) && isEpisode(strings.TrimSuffix(key, chaptersSuffix))
+}
+
+// chaptersFile is the JSON chapters format of Podcasting 2.0, see
+// https://github.com/Podcastindex-org/podcast-namespace/blob/main/chapters/jsonChapters.md
+// The fields we don't use (e.g. img) are ignored when it's parsed.
+type chaptersFile struct {
+	Version  string        `json:"version"`
+	Chapters []chapterJSON `json:"chapters"`
+}
+
+type chapterJSON struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title,omitempty"`
+	URL       string  `json:"url,omitempty"`
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// parseChapters parses a chapters file, the chapters are sorted by their start.
+func parseChapters(data []byte) ([]Chapter, error) {
+	var f chaptersFile
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chapters: %v", err)
+	}
+
+	chapters := make([]Chapter, 0, len(f.Chapters))
+	for i, c := range f.Chapters {
+		if c.StartTime < 0 || (c.EndTime != 0 && c.EndTime < c.StartTime) {
+			return nil, fmt.Errorf("invalid chapter #%v: invalid startTime %v or endTime %v", i, c.StartTime, c.EndTime)
+		}
+		chapters = append(chapters, Chapter{seconds(c.StartTime), seconds(c.EndTime), c.Title, c.URL})
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	return chapters, nil
+}
+
+// ChaptersJSON encodes the chapters in the JSON chapters format of Podcasting 2.0.
+func ChaptersJSON(chapters []Chapter) ([]byte, error) {
+	f := chaptersFile{Version: "1.2.0", Chapters: make([]chapterJSON, 0, len(chapters))}
+	for _, c := range chapters {
+		f.Chapters = append(f.Chapters, chapterJSON{c.Start.Seconds(), c.End.Seconds(), c.Title, c.URL})
+	}
+
+	return json.Marshal(f)
+}
+
+// id3TOC is a table of contents (CTOC frame) of an ID3v2 tag.
+type id3TOC struct {
+	topLevel bool
+	children []string
+}
+
+// parseID3Chapter parses a CHAP frame of an ID3v2 tag, the title and the URL
+// are in its sub-frames.
+func parseID3Chapter(version byte, data []byte) (string, Chapter, error) {
+	var c Chapter
+
+	elementID, rest := splitText(0, data)
+	if len(rest) < 16 {
+		return "", c, errShortFrame
+	}
+
+	start, end := binary.BigEndian.Uint32(rest), binary.BigEndian.Uint32(rest[4:])
+	c.Start = time.Duration(start) * time.Millisecond
+	if end > start {
+		c.End = time.Duration(end) * time.Millisecond
+	}
+
+	for _, f := range id3FrameList(version, rest[16:], -1) {
+		switch f.id {
+		case "TIT2":
+			c.Title = id3Text(f.data)
+		case "WXXX":
+			// the encoding and the description are followed by the URL,
+			// which is always ISO-8859-1
+			if len(f.data) > 0 {
+				_, url := splitText(f.data[0], f.data[1:])
+				c.URL = strings.TrimRight(decodeText(0, url), "\x00")
+			}
+		}
+	}
+
+	return string(elementID), c, nil
+}
+
+// parseID3TOC parses a CTOC frame of an ID3v2 tag.
+func parseID3TOC(data []byte) (string, id3TOC, error) {
+	var toc id3TOC
+
+	elementID, rest := splitText(0, data)
+	if len(rest) < 2 {
+		return "", toc, errShortFrame
+	}
+
+	toc.topLevel = rest[0]&0x02 != 0
+	count := int(rest[1])
+	rest = rest[2:]
+	for i := 0; i < count && len(rest) > 0; i++ {
+		var child []byte
+		child, rest = splitText(0, rest)
+		toc.children = append(toc.children, string(child))
+	}
+
+	return string(elementID), toc, nil
+}
+
+// id3Chapters returns the chapters of an ID3v2 tag. If the tag has a top-level
+// table of contents its chapters are returned in its order, otherwise all
+// chapters are returned sorted by their start.
+func id3Chapters(chapters map[string]Chapter, tocs []id3TOC) []Chapter {
+	if len(chapters) == 0 {
+		return nil
+	}
+
+	var out []Chapter
+	for _, toc := range tocs {
+		if !toc.topLevel {
+			continue
+		}
+		for _, id := range toc.children {
+			if c, ok := chapters[id]; ok {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+
+	for _, c := range chapters {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Start == out[j].Start {
+			return out[i].Title < out[j].Title
+		}
+		return out[i].Start < out[j].Start
+	})
+	return out
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// The iCalendar feed (RFC 5545) of the scheduled episodes is small enough to be
+// written by hand, it has one event for the release of every scheduled episode.
+
+// calendarTime formats a time in UTC like iCalendar expects.
+func calendarTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// calendarText escapes the text of a property value.
+var calendarText = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeCalendarLine writes a content line, lines longer than 75 octets are
+// folded by continuing them on the next line after a space.
+func writeCalendarLine(w *bufio.Writer, name, value string) {
+	line := name + ":" + value
+	// the space of the continuation lines counts towards their length
+	for limit := 75; len(line) > limit; limit = 74 {
+		// don't split UTF-8 sequences
+		i := limit
+		for i > 0 && line[i]&0xc0 == 0x80 {
+			i--
+		}
+		w.WriteString(line[:i] + "\r\n ")
+		line = line[i:]
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// writeCalendar writes the iCalendar feed of the episodes of the channels
+// that are scheduled to be published to w.
+func (s *server) writeCalendar(w io.Writer, channels []*channel) error {
+	bw := bufio.NewWriter(w)
+	now := calendarTime(time.Now())
+
+	writeCalendarLine(bw, "BEGIN", "VCALENDAR")
+	writeCalendarLine(bw, "VERSION", "2.0")
+	writeCalendarLine(bw, "PRODID", "-//polarpayne//pp//EN")
+	writeCalendarLine(bw, "X-WR-CALNAME", "Scheduled episodes")
+
+	for _, c := range channels {
+		for _, p := range c.getScheduled() {
+			pd := p.Details()
+
+			// the GUID of the episode, so that moving the release updates the event
+			guid := pd.GUID
+			if guid == "" {
+				guid = pp.KeyGUID(pd.Key)
+			}
+
+			writeCalendarLine(bw, "BEGIN", "VEVENT")
+			writeCalendarLine(bw, "UID", guid)
+			writeCalendarLine(bw, "DTSTAMP", now)
+			writeCalendarLine(bw, "DTSTART", calendarTime(pd.Published))
+			writeCalendarLine(bw, "SUMMARY", calendarText.Replace(c.name+": "+pd.Title))
+			description := pd.Key
+			if !pd.Expires.IsZero() {
+				description += "\nExpires " + pd.Expires.Format(time.RFC1123Z)
+			}
+			writeCalendarLine(bw, "DESCRIPTION", calendarText.Replace(description))
+			writeCalendarLine(bw, "END", "VEVENT")
+		}
+	}
+
+	writeCalendarLine(bw, "END", "VCALENDAR")
+	return bw.Flush()
+}
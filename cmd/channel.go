@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// channel is a single podcast feed, every channel has its own backend and
+// therefore its own episodes.
+type channel struct {
+	id          string
+	name        string
+	description string
+	// restricted channels are only visible to users that have been granted
+	// access to them in storage, other channels are visible to everyone that can log in
+	restricted bool
+	backend    pp.Backend
+
+	podcasts      podcastList
+	podcastsMutex sync.RWMutex
+	// updatedAt is when the podcasts were last updated successfully, failures
+	// is the number of updates that have failed since then and updateErr the
+	// error of the latest one
+	updatedAt time.Time
+	failures  int
+	updateErr error
+}
+
+func newChannel(id, name, description string, restricted bool, backend pp.Backend) *channel {
+	return &channel{
+		id:          id,
+		name:        name,
+		description: description,
+		restricted:  restricted,
+		backend:     backend,
+	}
+}
+
+// channelConfig is a single entry in the channels file (or the channels of
+// the config file), exactly one of Bucket and Dir should be set.
+type channelConfig struct {
+	ID          string `json:"id" yaml:"id"`
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description" yaml:"description"`
+	Restricted  bool   `json:"restricted" yaml:"restricted"`
+	Logo        string `json:"logo" yaml:"logo"`
+	Bucket      string `json:"bucket" yaml:"bucket"`
+	Prefix      string `json:"prefix" yaml:"prefix"`
+	Dir         string `json:"dir" yaml:"dir"`
+	// Timezone is the timezone of the published dates and times of the
+	// episodes that don't have one, the timezone flag by default
+	Timezone string `json:"timezone" yaml:"timezone"`
+}
+
+// channelCatalog creates the catalog of the channel with the given id, the
+// catalog is kept in memory if catalogDir is empty.
+func channelCatalog(catalogDir, id string) (*pp.Catalog, error) {
+	if catalogDir == "" {
+		return pp.NewCatalog("", logger)
+	}
+
+	return pp.NewCatalog(filepath.Join(catalogDir, id+".json"), logger)
+}
+
+// loadChannels reads the channels from a JSON file containing a list of channelConfigs.
+func loadChannels(path, catalogDir string) ([]*channel, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var configs []channelConfig
+	dec := json.NewDecoder(fp)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("failed to parse channels file %q: %v", path, err)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("channels file %q does not contain any channels", path)
+	}
+
+	return newChannels(configs, catalogDir)
+}
+
+// newChannels creates the channels of the channelConfigs, the catalogs of the
+// channels are persisted in catalogDir.
+func newChannels(configs []channelConfig, catalogDir string) ([]*channel, error) {
+	seen := make(map[string]bool)
+	out := make([]*channel, 0, len(configs))
+	for i, c := range configs {
+		if c.ID == "" {
+			return nil, fmt.Errorf("channel #%v does not have an id", i)
+		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("channel id %q is used more than once", c.ID)
+		}
+		seen[c.ID] = true
+
+		if (c.Bucket == "") == (c.Dir == "") {
+			return nil, fmt.Errorf("channel %q must have exactly one of bucket and dir set", c.ID)
+		}
+
+		if c.Name == "" {
+			c.Name = c.ID
+		}
+		if c.Logo == "" {
+			c.Logo = "logo.png"
+		}
+
+		catalog, err := channelCatalog(catalogDir, c.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Timezone == "" {
+			c.Timezone = *flagTimezone
+		}
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q has an invalid timezone %q: %v", c.ID, c.Timezone, err)
+		}
+
+		var backend pp.Backend
+		if c.Dir != "" {
+			backend = pp.NewBackendFS(c.Dir, c.Logo, catalog, logger.With("channel", c.ID)).WithLocation(loc)
+		} else {
+			backend = pp.NewBackendS3(c.Bucket, c.Prefix, c.Logo, catalog, logger.With("channel", c.ID)).WithLocation(loc)
+		}
+
+		out = append(out, newChannel(c.ID, c.Name, c.Description, c.Restricted, backend))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+const commandsUsage = `usage: pp [flags] [command]
+
+commands:
+  serve                                    start the server (the default)
+  users list                               list the users
+  users add <user-id> [hosted-domain]      add a user and print their feed URL
+  users rotate <user-id> [reason]          give the user a new secret and print their feed URL
+  users revoke <secret-or-url> [reason]    revoke a (leaked) secret, its user gets a new secret
+  episodes list [-c channel]               list the episodes of the channels
+  episodes validate [-c channel]           check the backends for files that are skipped or ignored
+  stats                                    print the requests per episode and the feed clients
+  feed render [-c channel] [-user id]      print the feed of a channel as the user would get it
+  migrate up|down|status                   apply, revert or list the database migrations
+  config check                             validate the configuration and print where each setting came from
+
+flags:
+`
+
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), commandsUsage)
+	flag.PrintDefaults()
+}
+
+// newTable returns a writer that aligns the tab separated columns written to
+// it, it has to be flushed.
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+}
+
+// formatDate formats t for the tables of the commands, the zero time is never.
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// parseChannelFlag parses the -c flag of a command and returns all channels
+// and the ones selected by the flag (all of them if the flag isn't set).
+func parseChannelFlag(fs *flag.FlagSet, args []string) ([]*channel, []*channel, error) {
+	id := fs.String("c", "", "ID of the channel, all channels if not set")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channels, err := setupChannels()
+	if err != nil {
+		return nil, nil, err
+	}
+	if *id == "" {
+		return channels, channels, nil
+	}
+
+	for _, c := range channels {
+		if c.id == *id {
+			return channels, []*channel{c}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("channel %q does not exist", *id)
+}
+
+// feedURL returns the feed URL of the default channel for the secret.
+func feedURL(secret string) string {
+	return *flagBaseURL + "/feed?s=" + secret
+}
+
+// addUser creates the user and prints their feed URL to w. The feed URL only
+// works for the users allowed by the access rules when they are enforced, so a
+// user that isn't allowed gets a rule for their email.
+func addUser(w io.Writer, storage pp.Storage, enforceACL bool, userID, hostedDomain string) error {
+	secret, err := storage.CreateUser(userID, hostedDomain)
+	if err != nil {
+		return err
+	}
+
+	if enforceACL {
+		allowed, err := storage.UserAllowed(userID, hostedDomain)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			rule, err := pp.NormalizeAccessRule(userID)
+			if err != nil {
+				logger.Warn("no access rule allows the user, add one for the feed URL to work", "user", userID, "error", err)
+			} else {
+				err = storage.AddAccessRule(rule)
+				if err != nil {
+					return err
+				}
+				logger.Info("added an access rule for the user", "user", userID, "rule", rule)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, feedURL(secret))
+	return nil
+}
+
+func runUsers(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pp users list|add|rotate|revoke")
+	}
+
+	storage, err := setupStorage()
+	if err != nil {
+		return err
+	}
+
+	// reason returns the optional reason argument at index i
+	reason := func(i int, def string) string {
+		if len(args) > i && args[i] != "" {
+			return args[i]
+		}
+		return def
+	}
+
+	switch args[0] {
+	case "list":
+		users, err := storage.Users()
+		if err != nil {
+			return err
+		}
+
+		w := newTable(os.Stdout)
+		fmt.Fprintln(w, "USER\tROLE\tSTATUS\tCREATED\tSECRET CREATED\tFEED LAST SEEN\tEPISODE LAST SEEN")
+		for _, u := range users {
+			status := "active"
+			if u.Suspended {
+				status = "suspended: " + u.SuspendedReason
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				u.ID, u.Role, status, formatDate(u.CreatedAt), formatDate(u.SecretCreatedAt),
+				formatDate(u.LastFeed), formatDate(u.LastPodcast))
+		}
+		return w.Flush()
+
+	case "add":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: pp users add <user-id> [hosted-domain]")
+		}
+
+		return addUser(os.Stdout, storage, *flagACLEnforce, args[1], reason(2, ""))
+
+	case "rotate":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: pp users rotate <user-id> [reason]")
+		}
+
+		secret, err := storage.RotateSecret(args[1], reason(2, "rotated from the command line"))
+		if err != nil {
+			return err
+		}
+		fmt.Println(feedURL(secret))
+		return nil
+
+	case "revoke":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: pp users revoke <secret-or-url> [reason]")
+		}
+
+		return storage.RevokeSecret(secretFromInput(args[1]), reason(2, "revoked from the command line"))
+	}
+
+	return fmt.Errorf("unknown users command %q", args[0])
+}
+
+func runEpisodes(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pp episodes list|validate [-c channel]")
+	}
+
+	_, channels, err := parseChannelFlag(flag.NewFlagSet("episodes "+args[0], flag.ExitOnError), args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		w := newTable(os.Stdout)
+		fmt.Fprintln(w, "CHANNEL\tPUBLISHED\tEXPIRES\tTITLE\tSIZE\tKEY")
+		for _, c := range channels {
+			// unlike the server, scheduled and expired episodes are listed too
+			podcasts, err := c.backend.ListPodcasts()
+			if err != nil {
+				return fmt.Errorf("failed to list the episodes of channel %q: %v", c.id, err)
+			}
+
+			sort.Sort(podcastList(podcasts))
+			for _, p := range podcasts {
+				pd := p.Details()
+				expires := "-"
+				if !pd.Expires.IsZero() {
+					expires = pd.Expires.Format("2006-01-02 15:04 MST")
+				}
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", c.id, pd.Published.Format("2006-01-02 15:04 MST"), expires, pd.Title, pd.Size, pd.Key)
+			}
+		}
+		return w.Flush()
+
+	case "validate":
+		var problems int
+		for _, c := range channels {
+			validator, ok := c.backend.(pp.Validator)
+			if !ok {
+				fmt.Printf("%v: the backend can't be validated\n", c.id)
+				continue
+			}
+
+			found, err := validator.Validate()
+			if err != nil {
+				return fmt.Errorf("failed to validate channel %q: %v", c.id, err)
+			}
+			for _, problem := range found {
+				fmt.Printf("%v: %v\n", c.id, problem)
+			}
+			problems += len(found)
+		}
+
+		if problems > 0 {
+			return fmt.Errorf("found %v problem(s)", problems)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown episodes command %q", args[0])
+}
+
+func runStats(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: pp stats")
+	}
+
+	storage, err := setupStorage()
+	if err != nil {
+		return err
+	}
+
+	episodes, err := storage.EpisodeStats()
+	if err != nil {
+		return err
+	}
+	clients, err := storage.FeedClients()
+	if err != nil {
+		return err
+	}
+
+	w := newTable(os.Stdout)
+	fmt.Fprintln(w, "CHANNEL\tEPISODE\tREQUESTS\tUSERS\tLAST REQUEST")
+	for _, e := range episodes {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", e.Channel, e.Key, e.Requests, e.Users, formatDate(e.LastRequest))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "USER\tCHANNEL\tUSER AGENT\tREFERER\tREQUESTS\tLAST SEEN")
+	for _, c := range clients {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", c.UserID, c.Channel, c.UserAgent, c.Referer, c.Requests, formatDate(c.LastSeen))
+	}
+	return w.Flush()
+}
+
+func runFeed(args []string) error {
+	if len(args) == 0 || args[0] != "render" {
+		return errors.New("usage: pp feed render [-c channel] [-user id]")
+	}
+
+	fs := flag.NewFlagSet("feed render", flag.ExitOnError)
+	userID := fs.String("user", "", "ID of the user whose secret is in the episode URLs, the URLs have no secret if not set")
+	channels, selected, err := parseChannelFlag(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	// without -c the default channel is rendered
+	c := selected[0]
+
+	var (
+		storage pp.Storage
+		secret  string
+	)
+	if *userID != "" {
+		storage, err = setupStorage()
+		if err != nil {
+			return err
+		}
+		secret, err = storage.UserSecret(*userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the server is only used for rendering, it's never started
+	s := newServer(*flagBaseURL, "", channels, nil, storage, false, nil, nil, 0, 0, "", false, logger)
+
+	err = c.updatePodcasts(logger)
+	if err != nil {
+		return err
+	}
+	err = s.writeFeed(os.Stdout, c, secret)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/polarpayne/pp/pptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddUser(t *testing.T) {
+	assert := assert.New(t)
+	storage := pptest.NewStorage()
+	assert.NoError(storage.AddAccessRule("@example.com"))
+
+	// a user allowed by a rule doesn't get another one
+	var out bytes.Buffer
+	assert.NoError(addUser(&out, storage, true, "alice@example.com", ""))
+	secret, err := storage.UserSecret("alice@example.com")
+	assert.NoError(err)
+	assert.Equal(feedURL(secret)+"\n", out.String())
+
+	rules, err := storage.AccessRules()
+	assert.NoError(err)
+	assert.Equal([]string{"@example.com"}, rules)
+
+	// the feed URL of a user that isn't allowed only works with a rule for them
+	out.Reset()
+	assert.NoError(addUser(&out, storage, true, "Bob@other.example", ""))
+	allowed, err := storage.UserAllowed("Bob@other.example", "")
+	assert.NoError(err)
+	assert.True(allowed)
+
+	rules, err = storage.AccessRules()
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"@example.com", "bob@other.example"}, rules)
+
+	// without enforcing no rules are needed
+	assert.NoError(addUser(&out, storage, false, "carol@other.example", ""))
+	allowed, err = storage.UserAllowed("carol@other.example", "")
+	assert.NoError(err)
+	assert.False(allowed)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"gopkg.in/yaml.v3"
+)
+
+// The settings are read from (in order of precedence) the flags, the
+// environment variables, the config file and the defaults of the flags. Every
+// flag has an environment variable and most of them a key in the config file.
+
+// flagEnv maps the name of every flag to its environment variable.
+var flagEnv = make(map[string]string)
+
+func stringFlag(name, env, def, usage string) *string {
+	flagEnv[name] = env
+	return flag.String(name, def, usage+" ($"+env+")")
+}
+
+func boolFlag(name, env string, def bool, usage string) *bool {
+	flagEnv[name] = env
+	return flag.Bool(name, def, usage+" ($"+env+")")
+}
+
+func int64Flag(name, env string, def int64, usage string) *int64 {
+	flagEnv[name] = env
+	return flag.Int64(name, def, usage+" ($"+env+")")
+}
+
+func durationFlag(name, env string, def time.Duration, usage string) *time.Duration {
+	flagEnv[name] = env
+	return flag.Duration(name, def, usage+" ($"+env+")")
+}
+
+// Where the value of a flag came from.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+// configValue is a single value in the config file, lists are joined with
+// commas like the flags expect them.
+type configValue struct {
+	value string
+}
+
+func (v *configValue) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		v.value = node.Value
+		return nil
+
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %v: expected a list of values", item.Line)
+			}
+			items = append(items, item.Value)
+		}
+		v.value = strings.Join(items, ",")
+		return nil
+	}
+
+	return fmt.Errorf("line %v: expected a value or a list of values", node.Line)
+}
+
+// config is the config file, a value that isn't in the file is nil.
+type config struct {
+	BaseURL         *configValue `yaml:"base_url"`
+	Host            *configValue `yaml:"host"`
+	Port            *configValue `yaml:"port"`
+	ShutdownTimeout *configValue `yaml:"shutdown_timeout"`
+	Name            *configValue `yaml:"name"`
+	Description     *configValue `yaml:"description"`
+	HelpText        *configValue `yaml:"help_text"`
+	Timezone        *configValue `yaml:"timezone"`
+	NoSecureCookie  *configValue `yaml:"no_secure_cookie"`
+	BehindProxy     *configValue `yaml:"behind_proxy"`
+	MetricsToken    *configValue `yaml:"metrics_token"`
+
+	Log struct {
+		Level  *configValue `yaml:"level"`
+		Format *configValue `yaml:"format"`
+	} `yaml:"log"`
+	CatalogDir *configValue `yaml:"catalog_dir"`
+
+	Database struct {
+		Conn   *configValue `yaml:"conn"`
+		NoInit *configValue `yaml:"no_init"`
+	} `yaml:"database"`
+
+	Auth struct {
+		Provider     *configValue `yaml:"provider"`
+		ClientID     *configValue `yaml:"client_id"`
+		ClientSecret *configValue `yaml:"client_secret"`
+		CookieKey    *configValue `yaml:"cookie_key"`
+		OIDC         struct {
+			Issuer            *configValue `yaml:"issuer"`
+			Scopes            *configValue `yaml:"scopes"`
+			UserClaim         *configValue `yaml:"user_claim"`
+			HostedDomainClaim *configValue `yaml:"hosted_domain_claim"`
+			AllowUnverified   *configValue `yaml:"allow_unverified_email"`
+		} `yaml:"oidc"`
+	} `yaml:"auth"`
+
+	Sessions struct {
+		MaxAge      *configValue `yaml:"max_age"`
+		IdleTimeout *configValue `yaml:"idle_timeout"`
+	} `yaml:"sessions"`
+
+	Access struct {
+		Admins  *configValue `yaml:"admins"`
+		Enforce *configValue `yaml:"enforce"`
+	} `yaml:"access"`
+
+	Leaks struct {
+		Action             *configValue `yaml:"action"`
+		Window             *configValue `yaml:"window"`
+		Interval           *configValue `yaml:"interval"`
+		MaxUserAgents      *configValue `yaml:"max_user_agents"`
+		MaxClientIPs       *configValue `yaml:"max_client_ips"`
+		MaxEpisodeRequests *configValue `yaml:"max_episode_requests"`
+	} `yaml:"leaks"`
+
+	// Backend is the backend of the default channel if there are no Channels
+	Backend struct {
+		Bucket *configValue `yaml:"bucket"`
+		Dir    *configValue `yaml:"dir"`
+		Logo   *configValue `yaml:"logo"`
+	} `yaml:"backend"`
+
+	Channels []channelConfig `yaml:"channels"`
+}
+
+// flagValues maps the names of the flags to their values in the config file.
+func (c *config) flagValues() map[string]*configValue {
+	return map[string]*configValue{
+		"base-url":                    c.BaseURL,
+		"host":                        c.Host,
+		"port":                        c.Port,
+		"shutdown-timeout":            c.ShutdownTimeout,
+		"name":                        c.Name,
+		"description":                 c.Description,
+		"help-text":                   c.HelpText,
+		"timezone":                    c.Timezone,
+		"no-secure-cookie":            c.NoSecureCookie,
+		"behind-proxy":                c.BehindProxy,
+		"metrics-token":               c.MetricsToken,
+		"log-level":                   c.Log.Level,
+		"log-format":                  c.Log.Format,
+		"catalog-dir":                 c.CatalogDir,
+		"db-conn":                     c.Database.Conn,
+		"db-no-init":                  c.Database.NoInit,
+		"auth-provider":               c.Auth.Provider,
+		"oauth-client-id":             c.Auth.ClientID,
+		"oauth-client-secret":         c.Auth.ClientSecret,
+		"cookie-key":                  c.Auth.CookieKey,
+		"oidc-issuer":                 c.Auth.OIDC.Issuer,
+		"oidc-scopes":                 c.Auth.OIDC.Scopes,
+		"oidc-user-claim":             c.Auth.OIDC.UserClaim,
+		"oidc-hosted-domain-claim":    c.Auth.OIDC.HostedDomainClaim,
+		"oidc-allow-unverified-email": c.Auth.OIDC.AllowUnverified,
+		"session-max-age":             c.Sessions.MaxAge,
+		"session-idle-timeout":        c.Sessions.IdleTimeout,
+		"admins":                      c.Access.Admins,
+		"acl-enforce":                 c.Access.Enforce,
+		"leak-action":                 c.Leaks.Action,
+		"leak-window":                 c.Leaks.Window,
+		"leak-interval":               c.Leaks.Interval,
+		"leak-max-user-agents":        c.Leaks.MaxUserAgents,
+		"leak-max-client-ips":         c.Leaks.MaxClientIPs,
+		"leak-max-episode-requests":   c.Leaks.MaxEpisodeRequests,
+		"backend-bucket":              c.Backend.Bucket,
+		"backend-dir":                 c.Backend.Dir,
+		"backend-logo":                c.Backend.Logo,
+	}
+}
+
+// readConfig reads the config file at path, unknown keys are an error so that
+// typos don't go unnoticed.
+func readConfig(path string) (*config, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	c := new(config)
+	dec := yaml.NewDecoder(fp)
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// isBoolFlag returns true for the flags that don't need a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// loadSettings parses the flags in args and then sets the flags that weren't
+// given from the environment (looked up with lookupEnv) and the config file
+// (whose path is in the flag configFlag). It returns the source of every flag
+// and the config file, which is nil if there is none.
+func loadSettings(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool), configFlag string) (map[string]string, *config, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sources := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { sources[f.Name] = sourceDefault })
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = sourceFlag })
+
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		env, ok := flagEnv[f.Name]
+		if !ok || sources[f.Name] != sourceDefault {
+			return
+		}
+		value, ok := lookupEnv(env)
+		if !ok {
+			return
+		}
+
+		// an empty variable has always meant false
+		if value == "" && isBoolFlag(f) {
+			value = "false"
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value %q for %v: %v", value, env, err))
+			return
+		}
+		sources[f.Name] = sourceEnv
+	})
+	if len(errs) > 0 {
+		return nil, nil, errors.New(strings.Join(errs, ", "))
+	}
+
+	var c *config
+	if f := fs.Lookup(configFlag); f != nil && f.Value.String() != "" {
+		c, err = readConfig(f.Value.String())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for name, value := range c.flagValues() {
+			f := fs.Lookup(name)
+			if value == nil || f == nil || sources[name] != sourceDefault {
+				continue
+			}
+			if err := f.Value.Set(value.value); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid value %q for %v in the config file: %v", value.value, name, err))
+				continue
+			}
+			sources[name] = sourceFile
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, nil, errors.New(strings.Join(errs, ", "))
+	}
+
+	return sources, c, nil
+}
+
+// validateSettings checks the settings that can be checked without connecting
+// to anything, it returns every problem it finds.
+func validateSettings() []string {
+	var problems []string
+	problemf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	u, err := url.Parse(*flagBaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problemf("base-url must be an absolute http(s) URL (it was %q)", *flagBaseURL)
+	}
+	if strings.HasSuffix(*flagBaseURL, "/") {
+		problemf("base-url must not end with a '/' (it was %q)", *flagBaseURL)
+	}
+
+	if port, err := strconv.Atoi(*flagPort); err != nil || port < 0 || port > 65535 {
+		problemf("port must be a port number (it was %q)", *flagPort)
+	}
+
+	switch *flagAuthProvider {
+	case "google":
+	case "oidc":
+		if *flagOIDCIssuer == "" {
+			problemf("oidc-issuer must be set when auth-provider is oidc")
+		}
+		if *flagOIDCUserClaim == "" {
+			problemf("oidc-user-claim must be set when auth-provider is oidc")
+		}
+	default:
+		problemf("invalid auth-provider %q (expected google or oidc)", *flagAuthProvider)
+	}
+
+	if _, err := pp.ParseLevel(*flagLogLevel); err != nil {
+		problemf("%v", err)
+	}
+	if *flagLogFormat != pp.LogFormatText && *flagLogFormat != pp.LogFormatJSON {
+		problemf("invalid log-format %q (expected text or json)", *flagLogFormat)
+	}
+
+	if _, err := time.LoadLocation(*flagTimezone); err != nil {
+		problemf("invalid timezone %q: %v", *flagTimezone, err)
+	}
+
+	switch *flagLeakAction {
+	case "", leakActionLog, leakActionRotate, leakActionSuspend:
+	default:
+		problemf("invalid leak-action %q (expected log, rotate, suspend or nothing)", *flagLeakAction)
+	}
+
+	durations := map[string]time.Duration{
+		"session-max-age":      *flagSessionMaxAge,
+		"session-idle-timeout": *flagSessionIdle,
+		"leak-window":          *flagLeakWindow,
+		"leak-interval":        *flagLeakInterval,
+		"shutdown-timeout":     *flagShutdownTimeout,
+	}
+	for name, d := range durations {
+		if d <= 0 {
+			problemf("%v must be positive (it was %v)", name, d)
+		}
+	}
+
+	thresholds := map[string]int64{
+		"leak-max-user-agents":      *flagLeakUserAgents,
+		"leak-max-client-ips":       *flagLeakClientIPs,
+		"leak-max-episode-requests": *flagLeakPodcasts,
+	}
+	for name, t := range thresholds {
+		if t < 0 {
+			problemf("%v must not be negative (it was %v)", name, t)
+		}
+	}
+
+	if *flagDBConn == "" {
+		problemf("db-conn must be set")
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// secretFlags are not printed by config check.
+var secretFlags = map[string]bool{
+	"oauth-client-secret": true,
+	"cookie-key":          true,
+	"metrics-token":       true,
+}
+
+// redactedValue returns the value of the flag as it can be shown to the operator.
+func redactedValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if value == "" {
+		return ""
+	}
+	if secretFlags[f.Name] {
+		return "(redacted)"
+	}
+	if f.Name == "db-conn" {
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "redacted")
+				return u.String()
+			}
+		}
+	}
+	return value
+}
+
+// runConfig runs the config command, the settings have already been loaded
+// and validated by main when it runs.
+func runConfig(args []string, sources map[string]string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New("usage: pp config check")
+	}
+
+	// the channels are only checked when they are created
+	channels, err := setupChannels()
+	if err != nil {
+		return err
+	}
+
+	w := newTable(os.Stdout)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", f.Name, redactedValue(f), sources[f.Name])
+	})
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CHANNEL\tNAME\tRESTRICTED")
+	for _, c := range channels {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", c.id, c.name, c.restricted)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\nthe configuration is valid")
+	return nil
+}
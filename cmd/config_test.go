@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFlagSet returns flags named like the flags of the application, so
+// that they have environment variables and keys in the config file.
+func newTestFlagSet() (*flag.FlagSet, map[string]*string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	values := make(map[string]*string)
+	for _, name := range []string{"config", "host", "port", "name", "description"} {
+		values[name] = fs.String(name, "default "+name, "")
+	}
+	fs.Bool("acl-enforce", true, "")
+	return fs, values
+}
+
+// writeTestConfig writes a config file, it has to be removed by the caller.
+func writeTestConfig(t *testing.T, content string) string {
+	fp, err := ioutil.TempFile("", "pp-config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	_, err = fp.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fp.Name()
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	path := writeTestConfig(t, "host: file host\nport: 8000\nname: file name\n")
+	defer os.Remove(path)
+	env := map[string]string{
+		"PORT":         "9000",
+		"PODCAST_NAME": "env name",
+		"ACL_ENFORCE":  "",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	fs, values := newTestFlagSet()
+	sources, c, err := loadSettings(fs, []string{"-config", path, "-name", "flag name"}, lookupEnv, "config")
+	assert.NoError(t, err)
+	assert.NotNil(t, c)
+
+	assert.Equal(t, "flag name", *values["name"])
+	assert.Equal(t, "9000", *values["port"])
+	assert.Equal(t, "file host", *values["host"])
+	assert.Equal(t, "default description", *values["description"])
+	assert.Equal(t, "false", fs.Lookup("acl-enforce").Value.String(), "an empty variable is false")
+
+	assert.Equal(t, map[string]string{
+		"config":      sourceFlag,
+		"name":        sourceFlag,
+		"port":        sourceEnv,
+		"acl-enforce": sourceEnv,
+		"host":        sourceFile,
+		"description": sourceDefault,
+	}, sources)
+}
+
+func TestLoadSettingsInvalid(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	typo := writeTestConfig(t, "hots: typo\n")
+	defer os.Remove(typo)
+	fs, _ := newTestFlagSet()
+	_, _, err := loadSettings(fs, []string{"-config", typo}, noEnv, "config")
+	assert.Error(t, err, "unknown keys are an error")
+
+	invalid := writeTestConfig(t, "access:\n  enforce: maybe\n")
+	defer os.Remove(invalid)
+	fs, _ = newTestFlagSet()
+	_, _, err = loadSettings(fs, []string{"-config", invalid}, noEnv, "config")
+	assert.Error(t, err, "invalid values are an error")
+
+	fs, _ = newTestFlagSet()
+	_, _, err = loadSettings(fs, nil, func(string) (string, bool) { return "maybe", true }, "config")
+	assert.Error(t, err, "invalid environment variables are an error")
+
+	fs, _ = newTestFlagSet()
+	_, _, err = loadSettings(fs, []string{"-config", filepath.Join(os.TempDir(), "pp-missing.yaml")}, noEnv, "config")
+	assert.Error(t, err, "a missing config file is an error")
+}
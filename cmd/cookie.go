@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// signedCookie encodes values to cookies that can't be modified by the client
+// without it being noticed, the values are not encrypted though.
+type signedCookie struct {
+	key []byte
+}
+
+func (c signedCookie) mac(payload string) string {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// encode encodes v as JSON and signs it along with the time it expires at.
+func (c signedCookie) encode(v interface{}, expires time.Time) (string, error) {
+	data, err := json.Marshal(struct {
+		Value   interface{} `json:"v"`
+		Expires int64       `json:"e"`
+	}{v, expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + c.mac(payload), nil
+}
+
+// decode verifies the signature and expiry of the cookie value and decodes it into v.
+func (c signedCookie) decode(value string, v interface{}) error {
+	split := strings.SplitN(value, ".", 2)
+	if len(split) != 2 {
+		return errors.New("invalid signed cookie")
+	}
+
+	payload, mac := split[0], split[1]
+	if !hmac.Equal([]byte(mac), []byte(c.mac(payload))) {
+		return errors.New("invalid signature in signed cookie")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+
+	decoded := struct {
+		Value   json.RawMessage `json:"v"`
+		Expires int64           `json:"e"`
+	}{}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().Unix() > decoded.Expires {
+		return errors.New("signed cookie has expired")
+	}
+
+	return json.Unmarshal(decoded.Value, v)
+}
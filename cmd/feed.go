@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// The RSS feed is encoded with encoding/xml, the structs below only have the
+// elements we use. The names of the iTunes and Podcasting 2.0 elements include
+// their namespace prefix, which is declared on the rss element.
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Podcast string     `xml:"xmlns:podcast,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Generator     string    `xml:"generator"`
+	Language      string    `xml:"language"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	PubDate       string    `xml:"pubDate"`
+	Image         rssImage  `xml:"image"`
+	IBlock        string    `xml:"itunes:block"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssImage struct {
+	URL string `xml:"url"`
+}
+
+type rssItem struct {
+	GUID        rssGUID         `xml:"guid"`
+	Title       string          `xml:"title"`
+	Link        string          `xml:"link"`
+	Description string          `xml:"description"`
+	PubDate     string          `xml:"pubDate"`
+	Enclosure   rssEnclosure    `xml:"enclosure"`
+	IImage      rssITunesImage  `xml:"itunes:image"`
+	IAuthor     string          `xml:"itunes:author,omitempty"`
+	IDuration   string          `xml:"itunes:duration,omitempty"`
+	IExplicit   string          `xml:"itunes:explicit,omitempty"`
+	IEpisode    int             `xml:"itunes:episode,omitempty"`
+	ISeason     int             `xml:"itunes:season,omitempty"`
+	PChapters   *rssChapters    `xml:"podcast:chapters"`
+	PTranscript []rssTranscript `xml:"podcast:transcript"`
+}
+
+// rssGUID is the GUID of an item, it's never the URL of the episode.
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// rssChapters refers to the chapters of an episode in the JSON chapters format,
+// see https://github.com/Podcastindex-org/podcast-namespace.
+type rssChapters struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// rssTranscript refers to a transcript of an episode, rel is "captions" for
+// the formats with timestamps.
+type rssTranscript struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type rssITunesImage struct {
+	HREF string `xml:"href,attr"`
+}
+
+// formatDuration formats the duration of an episode like iTunes expects (H:MM:SS).
+func formatDuration(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// contentType returns the content type of the episode, backends that don't set
+// it get the one of the extension of the key.
+func contentType(pd pp.PodcastDetails) string {
+	if pd.ContentType == "" {
+		return pp.MediaType(pd.Key)
+	}
+	return pd.ContentType
+}
+
+// artworkURL returns the URL of the artwork of the episode (set by the sidecar
+// or embedded in the file), the logo of the channel is used if the episode
+// doesn't have its own.
+func (s *server) artworkURL(c *channel, secret string, pd pp.PodcastDetails) string {
+	switch {
+	case pd.Artwork == "" && pd.EmbeddedArtwork == nil:
+		return s.channelURL("/logo", c, "", nil)
+	case pp.IsArtworkURL(pd.Artwork):
+		return pd.Artwork
+	}
+
+	q := url.Values{}
+	q.Set("n", pd.Key)
+	return s.channelURL("/artwork", c, secret, q)
+}
+
+// writeFeed writes the RSS feed of the channel with the episode URLs of the
+// given secret to w.
+func (s *server) writeFeed(w io.Writer, c *channel, secret string) error {
+	now := time.Now().Format(time.RFC1123Z)
+
+	feed := rssFeed{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Podcast: "https://podcastindex.org/namespace/1.0",
+		Channel: rssChannel{
+			Title:         c.name,
+			Link:          s.baseURL,
+			Description:   c.description,
+			Generator:     "pp (github.com/polarpayne/pp)",
+			Language:      "en-us",
+			LastBuildDate: now,
+			PubDate:       now,
+			Image:         rssImage{s.channelURL("/logo", c, "", nil)},
+			IBlock:        "yes",
+		},
+	}
+
+	for _, p := range c.getPodcasts() {
+		pd := p.Details()
+
+		q := url.Values{}
+		q.Set("n", pd.Key)
+		podcastURL := s.channelURL("/podcast", c, secret, q)
+
+		description := pd.Description
+		if description == "" {
+			description = pd.Title
+		}
+
+		// the URL can't be the GUID since it changes with the secret of the
+		// user, the backends that don't set a GUID get one derived from the key
+		guid := pd.GUID
+		if guid == "" {
+			guid = pp.KeyGUID(pd.Key)
+		}
+
+		item := rssItem{
+			GUID:        rssGUID{"false", guid},
+			Title:       pd.Title,
+			Link:        podcastURL,
+			Description: description,
+			PubDate:     pd.Published.Format(time.RFC1123Z),
+			Enclosure:   rssEnclosure{podcastURL, pd.Size, contentType(pd)},
+			IImage:      rssITunesImage{s.artworkURL(c, secret, pd)},
+			IAuthor:     pd.Artist,
+			IEpisode:    pd.Episode,
+			ISeason:     pd.Season,
+		}
+		if item.IEpisode == 0 {
+			// the track number of the tags is the episode number
+			item.IEpisode = pd.Track
+		}
+		if pd.Duration > 0 {
+			item.IDuration = formatDuration(pd.Duration)
+		}
+		if pd.Explicit {
+			item.IExplicit = "true"
+		}
+		if len(pd.Chapters) > 0 {
+			item.PChapters = &rssChapters{s.channelURL("/chapters", c, secret, q), chaptersContentType}
+		}
+
+		for _, t := range pd.Transcripts {
+			tq := url.Values{}
+			tq.Set("n", pd.Key)
+			tq.Set("t", t.Format())
+			transcript := rssTranscript{URL: s.channelURL("/transcript", c, secret, tq), Type: t.ContentType}
+			if t.Format() != "txt" {
+				transcript.Rel = "captions"
+			}
+			item.PTranscript = append(item.PTranscript, transcript)
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(feed)
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/eduncan911/podcast"
+	"github.com/polarpayne/pp"
 )
 
 // handleError writes the error message to the log and then sends a 500 status code
@@ -17,15 +25,88 @@ import (
 // These log messages look like `http: superfluous response.WriteHeader call from`,
 // and are completely harmless.
 func (s *server) handleError(w http.ResponseWriter, r *http.Request, err error) {
-	log.Printf("internal server error when handling a request to %q: %v", r.URL.EscapedPath(), err)
+	s.logger(r).Error("internal server error", "error", err)
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
+// requestIDHeader is the header with the ID of the request, it's taken from
+// the request if the proxy in front of us set it and added to the response.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs that are taken from the request.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to create a request ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// logger returns the logger of the request, its messages have the ID of the request.
+func (s *server) logger(r *http.Request) pp.Logger {
+	return pp.LoggerFromContext(r.Context(), s.log)
+}
+
+// handleRequest gives the request an ID, logs the request when it's done and
+// records it in the metrics of the handler. The query isn't logged since it
+// contains the secrets.
+func (s *server) handleRequest(handler string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := s.log.With("request_id", id)
+		r = r.WithContext(pp.ContextWithLogger(r.Context(), logger))
+
+		mw := &metricsWriter{ResponseWriter: w}
+		f(mw, r)
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		duration := time.Since(start)
+		s.metrics.requests.add(1, handler, strconv.Itoa(status))
+		s.metrics.requestDuration.observe(duration, handler)
+
+		logger.Info("request",
+			"method", r.Method, "path", r.URL.EscapedPath(), "status", status,
+			"bytes", mw.written, "duration", duration, "client_ip", s.clientIP(r), "user_agent", r.UserAgent())
+	}
+}
+
+// clientIP returns the IP address of the client that made the request. Behind
+// a proxy (e.g. the Heroku router) the address the proxy saw is used instead,
+// otherwise X-Forwarded-For is ignored since any client can set it.
+func (s *server) clientIP(r *http.Request) string {
+	forwardedFor := r.Header.Get("X-Forwarded-For")
+	if s.behindProxy && forwardedFor != "" {
+		// every proxy appends the address it saw to the header, so the last
+		// value is the one added by the proxy in front of us
+		split := strings.Split(forwardedFor, ",")
+		return strings.TrimSpace(split[len(split)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (s *server) handleHTTPToHTTPS(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		forwardedProto := r.Header.Get("X-Forwarded-Proto")
 		if forwardedProto == "http" && strings.HasPrefix(s.baseURL, "https") {
-			log.Printf("request with X-Forwarded-Proto equal to HTTP and base URL is a HTTPS URL, redirecting user to HTTPS")
+			s.logger(r).Debug("request with X-Forwarded-Proto equal to HTTP and base URL is a HTTPS URL, redirecting user to HTTPS")
 			url := s.baseURL + r.URL.String()
 			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 			return
@@ -37,28 +118,93 @@ func (s *server) handleHTTPToHTTPS(f http.HandlerFunc) http.HandlerFunc {
 
 // handleSecret returns true if and only if the secret is valid, if handleSecret returns false
 // it will also write the correct status code and message to the response.
-func (s *server) handleSecret(w http.ResponseWriter, r *http.Request) (string, bool) {
+func (s *server) handleSecret(w http.ResponseWriter, r *http.Request) (string, string, bool) {
 	q := r.URL.Query()
 	secret := q.Get("s")
 
-	// TODO: logo access to database
+	user, ok, err := s.storage.UserBySecret(secret)
+	if err != nil {
+		s.handleError(w, r, err)
+		return "", "", false
+	}
+	if !ok {
+		s.logger(r).Info("invalid secret when trying to access feed", "secret", secret)
+		w.WriteHeader(http.StatusForbidden)
+		return "", "", false
+	}
+
+	// the allowlist is checked on every request, so that removing a user from
+	// it (or suspending them) takes effect immediately and not only on their next login
+	ok, err = s.userActive(user)
+	if err != nil {
+		s.handleError(w, r, err)
+		return "", "", false
+	}
+	if !ok {
+		s.logger(r).Info("user is suspended or not allowed by the access rules", "user", user.ID)
+		w.WriteHeader(http.StatusForbidden)
+		return "", "", false
+	}
+
+	return user.ID, secret, true
+}
+
+// handleChannel validates the secret (see handleSecret) and returns the channel
+// the request is for if the user has access to it. If handleChannel returns false it
+// will also write the correct status code and message to the response.
+func (s *server) handleChannel(w http.ResponseWriter, r *http.Request) (*channel, string, bool) {
+	userID, secret, ok := s.handleSecret(w, r)
+	if !ok {
+		return nil, "", false
+	}
+
+	c, ok := s.getChannel(r.URL.Query().Get("c"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, "", false
+	}
 
-	ok, err := s.storage.ValidSecret(secret)
+	ok, err := s.hasAccess(userID, c)
 	if err != nil {
 		s.handleError(w, r, err)
-		return "", false
+		return nil, "", false
 	}
 	if !ok {
-		log.Printf("invalid secret %q when trying to access feed", secret)
+		s.logger(r).Info("user does not have access to the channel", "user", userID, "channel", c.id)
 		w.WriteHeader(http.StatusForbidden)
-		return "", false
+		return nil, "", false
 	}
 
-	return secret, true
+	return c, secret, true
+}
+
+// channelURL returns an absolute URL to path with the channel and secret in
+// the query, the channel is left out for the default channel.
+func (s *server) channelURL(path string, c *channel, secret string, q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+	if c.id != s.getChannels()[0].id {
+		q.Set("c", c.id)
+	}
+	if secret != "" {
+		q.Set("s", secret)
+	}
+
+	if len(q) == 0 {
+		return s.baseURL + path
+	}
+	return s.baseURL + path + "?" + q.Encode()
 }
 
 func (s *server) handleLogo(w http.ResponseWriter, r *http.Request) {
-	logo, err := s.backend.GetLogo()
+	c, ok := s.getChannel(r.URL.Query().Get("c"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logo, err := c.backend.GetLogo()
 	if err != nil {
 		s.handleError(w, r, err)
 		return
@@ -67,81 +213,187 @@ func (s *server) handleLogo(w http.ResponseWriter, r *http.Request) {
 
 	_, err = io.Copy(w, logo)
 	if err != nil {
-		log.Printf("failed to write logo to response: %v", err)
+		s.logger(r).Warn("failed to write logo to response", "error", err)
 	}
 }
 
-func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) {
-	err := s.auth.HandleAuth(w, r, s.storage, *flagNoSecureCookie)
+// handleArtwork serves the artwork of an episode, only the artwork set for the
+// episode (or embedded in it) can be fetched and not any other file of the backend.
+func (s *server) handleArtwork(w http.ResponseWriter, r *http.Request) {
+	c, _, ok := s.handleChannel(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("n")
+
+	var (
+		artwork     io.ReadCloser
+		contentType string
+		err         error
+	)
+	for _, podcast := range c.getPodcasts() {
+		pd := podcast.Details()
+		if pd.Key != name {
+			continue
+		}
+
+		if pd.Artwork != "" && !pp.IsArtworkURL(pd.Artwork) {
+			artwork, err = c.backend.GetFile(pd.Artwork)
+			contentType = mime.TypeByExtension(path.Ext(pd.Artwork))
+		} else if reader, ok := podcast.(pp.ArtworkReader); ok && pd.Artwork == "" && pd.EmbeddedArtwork != nil {
+			artwork, err = reader.ReadArtwork()
+			contentType = pd.EmbeddedArtwork.ContentType
+		}
+		break
+	}
 	if err != nil {
 		s.handleError(w, r, err)
+		return
+	}
+	if artwork == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer artwork.Close()
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	_, err = io.Copy(w, artwork)
+	if err != nil {
+		s.logger(r).Warn("failed to write artwork to response", "error", err)
 	}
 }
 
-func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
-	secret, ok := s.handleSecret(w, r)
+// chaptersContentType is the content type of the JSON chapters format.
+const chaptersContentType = "application/json+chapters"
+
+// handleChapters serves the chapters of an episode in the JSON chapters format
+// of Podcasting 2.0.
+func (s *server) handleChapters(w http.ResponseWriter, r *http.Request) {
+	c, _, ok := s.handleChannel(w, r)
 	if !ok {
 		return
 	}
 
-	err := s.storage.LogFeed(secret, r.Referer(), r.UserAgent())
+	name := r.URL.Query().Get("n")
+
+	for _, podcast := range c.getPodcasts() {
+		pd := podcast.Details()
+		if pd.Key != name || len(pd.Chapters) == 0 {
+			continue
+		}
+
+		data, err := pp.ChaptersJSON(pd.Chapters)
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", chaptersContentType)
+		_, err = w.Write(data)
+		if err != nil {
+			s.logger(r).Warn("failed to write chapters to response", "error", err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// handleTranscript serves a transcript of an episode, t is the format of the
+// transcript (vtt, srt or txt). WebVTT is converted from SubRip if the episode
+// only has the latter, since <track> only supports WebVTT.
+func (s *server) handleTranscript(w http.ResponseWriter, r *http.Request) {
+	c, _, ok := s.handleChannel(w, r)
+	if !ok {
+		return
+	}
+
+	name, format := r.URL.Query().Get("n"), r.URL.Query().Get("t")
+
+	var transcript *pp.Transcript
+	for _, podcast := range c.getPodcasts() {
+		pd := podcast.Details()
+		if pd.Key != name {
+			continue
+		}
+
+		for i, t := range pd.Transcripts {
+			if t.Format() == format || (format == "vtt" && t.Format() == "srt" && transcript == nil) {
+				transcript = &pd.Transcripts[i]
+			}
+		}
+		break
+	}
+	if transcript == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f, err := c.backend.GetFile(transcript.Key)
 	if err != nil {
 		s.handleError(w, r, err)
 		return
 	}
+	defer f.Close()
 
-	now := time.Now()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("failed to read transcript: %v", err))
+		return
+	}
 
-	feed := podcast.New(s.name, s.baseURL, s.description, nil, &now)
-	feed.IBlock = "yes"
-	feed.Image = &podcast.Image{URL: s.baseURL + "/logo"}
-	for _, p := range s.getPodcasts() {
-		pd := p.Details()
+	contentType := transcript.ContentType
+	if transcript.Format() != format {
+		data, contentType = pp.SRTToVTT(data), "text/vtt"
+	}
 
-		q := url.Values{}
-		q.Set("s", secret)
-		q.Set("n", pd.Key)
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	_, err = w.Write(data)
+	if err != nil {
+		s.logger(r).Warn("failed to write transcript to response", "error", err)
+	}
+}
 
-		description := pd.Description
-		if description == "" {
-			description = pd.Title
-		}
+func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	c, secret, ok := s.handleChannel(w, r)
+	if !ok {
+		return
+	}
 
-		feed.AddItem(podcast.Item{
-			Title:       pd.Title,
-			Description: description,
-			PubDate:     &pd.Published,
-			Enclosure: &podcast.Enclosure{
-				Length: pd.Size,
-				Type:   podcast.MP3,
-				URL:    s.baseURL + "/podcast?" + q.Encode(),
-			},
-		})
+	err := s.storage.LogFeed(secret, c.id, r.Referer(), r.UserAgent(), s.clientIP(r))
+	if err != nil {
+		s.handleError(w, r, err)
+		return
 	}
 
-	err = feed.Encode(w)
+	err = s.writeFeed(w, c, secret)
 	if err != nil {
-		log.Printf("failed to write feed to response: %v", err)
+		s.logger(r).Warn("failed to write feed to response", "error", err)
 	}
 }
 
 func (s *server) handlePodcast(w http.ResponseWriter, r *http.Request) {
-	secret, ok := s.handleSecret(w, r)
+	c, secret, ok := s.handleChannel(w, r)
 	if !ok {
 		return
 	}
 
 	name := r.URL.Query().Get("n")
 
-	err := s.storage.LogPodcast(secret, name, r.Referer(), r.UserAgent())
+	err := s.storage.LogPodcast(secret, c.id, name, r.Referer(), r.UserAgent(), s.clientIP(r))
 	if err != nil {
 		s.handleError(w, r, err)
 		return
 	}
 
-	for _, podcast := range s.getPodcasts() {
+	for _, podcast := range c.getPodcasts() {
 		if podcast.Details().Key == name {
-			err := podcast.HandlePodcast(w, r)
+			mw := &metricsWriter{ResponseWriter: w}
+			err := podcast.HandlePodcast(mw, r)
+			s.metrics.episodeBytes.add(float64(mw.written), c.id, name)
 			if err != nil {
 				s.handleError(w, r, err)
 			}
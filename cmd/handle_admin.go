@@ -0,0 +1,508 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+var tmplAdmin = `
+<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="shortcut icon" href="/logo">
+	<title>Private Podcast - Admin</title>
+
+	<style>
+		body {
+			background: #eee;
+			font-family: sans-serif;
+		}
+
+		.content {
+			background: white;
+			margin: 1rem;
+			padding: 1rem;
+			border: 2px solid black;
+			overflow-x: auto;
+		}
+
+		table {
+			border-collapse: collapse;
+			width: 100%;
+		}
+
+		th, td {
+			border-bottom: 1px solid #ccc;
+			padding: 0.3rem;
+			text-align: left;
+			vertical-align: top;
+		}
+
+		form {
+			display: inline;
+		}
+
+		.suspended {
+			color: #a00;
+		}
+
+		.message {
+			font-weight: 900;
+		}
+	</style>
+</head>
+<body>
+	<div class="content">
+	<a href="/">home</a>
+
+	<h1>Admin</h1>
+
+	{{ if .Message }}
+	<p class="message">{{ .Message }}</p>
+	{{ end }}
+
+	{{ if .Flagged }}
+	<h2>Suspicious secrets</h2>
+	<p>The secrets of the following users looked leaked when they were last checked.</p>
+	<ul>
+		{{ range .Flagged }}
+		<li>{{ .UserID }} ({{ .Action }}, {{ .At | date }}): {{ range $i, $r := .Reasons }}{{ if $i }}, {{ end }}{{ $r }}{{ end }}</li>
+		{{ end }}
+	</ul>
+	{{ end }}
+
+	<h2>Users</h2>
+	<table>
+		<tr>
+			<th>User</th>
+			<th>Role</th>
+			<th>Created</th>
+			<th>Secret created</th>
+			<th>Feed last seen</th>
+			<th>Episode last seen</th>
+			<th>Restricted channels</th>
+			<th>Actions</th>
+		</tr>
+		{{ range .Users }}
+		<tr>
+			<td>
+				{{ .ID }}{{ if .HostedDomain }} ({{ .HostedDomain }}){{ end }}
+				{{ if .Suspended }}<div class="suspended">suspended: {{ .SuspendedReason }}</div>{{ end }}
+			</td>
+			<td>{{ .Role }}</td>
+			<td>{{ .CreatedAt | date }}</td>
+			<td>{{ .SecretCreatedAt | date }}</td>
+			<td>{{ .LastFeed | date }}</td>
+			<td>{{ .LastPodcast | date }}</td>
+			<td>
+				{{ $user := .ID }}
+				{{ range .Channels }}
+				<form method="post" action="/admin?action=revoke-channel">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ $user }}">
+					<input type="hidden" name="channel" value="{{ . }}">
+					{{ . }} <button type="submit">&times;</button>
+				</form>
+				{{ end }}
+				{{ if $.RestrictedChannels }}
+				<form method="post" action="/admin?action=grant-channel">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ .ID }}">
+					<select name="channel">
+						{{ range $.RestrictedChannels }}<option>{{ . }}</option>{{ end }}
+					</select>
+					<button type="submit">grant</button>
+				</form>
+				{{ end }}
+			</td>
+			<td>
+				<form method="post" action="/admin?action=rotate">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ .ID }}">
+					<input type="text" name="reason" placeholder="reason" required>
+					<button type="submit">rotate secret</button>
+				</form>
+				{{ if .Suspended }}
+				<form method="post" action="/admin?action=unsuspend">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ .ID }}">
+					<button type="submit">unsuspend</button>
+				</form>
+				{{ else }}
+				<form method="post" action="/admin?action=suspend">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ .ID }}">
+					<input type="text" name="reason" placeholder="reason" required>
+					<button type="submit">suspend</button>
+				</form>
+				{{ end }}
+				<form method="post" action="/admin?action=end-sessions">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ .ID }}">
+					<button type="submit">log out everywhere</button>
+				</form>
+				<form method="post" action="/admin?action=role">
+					<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+					<input type="hidden" name="user" value="{{ .ID }}">
+					{{ if eq .Role "admin" }}
+					<input type="hidden" name="role" value="user">
+					<button type="submit">remove admin</button>
+					{{ else }}
+					<input type="hidden" name="role" value="admin">
+					<button type="submit">make admin</button>
+					{{ end }}
+				</form>
+			</td>
+		</tr>
+		{{ end }}
+	</table>
+
+	<h3>Revoke a secret</h3>
+	<p>Paste a leaked secret or feed URL, the user that owns it gets a new secret.</p>
+	<form method="post" action="/admin?action=revoke">
+		<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+		<input type="text" name="secret" placeholder="secret or feed URL" required>
+		<input type="text" name="reason" placeholder="reason" required>
+		<button type="submit">revoke</button>
+	</form>
+
+	<h2>Access rules</h2>
+	{{ if not .EnforceACL }}
+	<p>The access rules are <strong>not enforced</strong>, anyone with an account is able to log in.</p>
+	{{ end }}
+	<ul>
+		{{ range .AccessRules }}
+		<li>
+			<form method="post" action="/admin?action=remove-rule">
+				<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+				<input type="hidden" name="rule" value="{{ . }}">
+				{{ . }} <button type="submit">&times;</button>
+			</form>
+		</li>
+		{{ end }}
+	</ul>
+	<form method="post" action="/admin?action=add-rule">
+		<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+		<input type="text" name="rule" placeholder="alice@example.com, @example.com or hd:example.com" required>
+		<button type="submit">add rule</button>
+	</form>
+
+	<h2>Scheduled episodes</h2>
+	<p>Subscribe to the releases in a calendar application: <a href="{{ .CalendarURL }}">{{ .CalendarURL }}</a></p>
+	<table>
+		<tr>
+			<th>Channel</th>
+			<th>Episode</th>
+			<th>Published</th>
+			<th>Expires</th>
+		</tr>
+		{{ range .Scheduled }}
+		<tr>
+			<td>{{ .Channel }}</td>
+			<td>{{ .Key }}</td>
+			<td>{{ .Published | date }}</td>
+			<td>{{ .Expires | date }}</td>
+		</tr>
+		{{ end }}
+	</table>
+
+	<h2>Episodes</h2>
+	<table>
+		<tr>
+			<th>Channel</th>
+			<th>Episode</th>
+			<th>Requests</th>
+			<th>Users</th>
+			<th>Last request</th>
+		</tr>
+		{{ range .Episodes }}
+		<tr>
+			<td>{{ .Channel }}</td>
+			<td>{{ .Key }}</td>
+			<td>{{ .Requests }}</td>
+			<td>{{ .Users }}</td>
+			<td>{{ .LastRequest | date }}</td>
+		</tr>
+		{{ end }}
+	</table>
+
+	<h2>Feed clients</h2>
+	<table>
+		<tr>
+			<th>User</th>
+			<th>Channel</th>
+			<th>User agent</th>
+			<th>Referer</th>
+			<th>Requests</th>
+			<th>Last seen</th>
+		</tr>
+		{{ range .FeedClients }}
+		<tr>
+			<td>{{ .UserID }}</td>
+			<td>{{ .Channel }}</td>
+			<td>{{ .UserAgent }}</td>
+			<td>{{ .Referer }}</td>
+			<td>{{ .Requests }}</td>
+			<td>{{ .LastSeen | date }}</td>
+		</tr>
+		{{ end }}
+	</table>
+
+	</div>
+</body>
+`
+
+// secretFromInput returns the secret in input, which is either the secret
+// itself or an URL (e.g. a feed URL) that contains the secret.
+func secretFromInput(input string) string {
+	input = strings.TrimSpace(input)
+
+	u, err := url.Parse(input)
+	if err == nil {
+		if secret := u.Query().Get("s"); secret != "" {
+			return secret
+		}
+	}
+
+	return input
+}
+
+// handleAdminAction executes the action of the POST request to the admin page and
+// returns the message that should be shown to the admin.
+func (s *server) handleAdminAction(admin pp.User, r *http.Request) (string, error) {
+	action := r.URL.Query().Get("action")
+	userID := r.PostFormValue("user")
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if reason != "" {
+		reason = fmt.Sprintf("%v (by %v)", reason, admin.ID)
+	}
+
+	s.logger(r).Info("admin action", "admin", admin.ID, "action", action, "user", userID)
+
+	switch action {
+	case "rotate":
+		_, err := s.storage.RotateSecret(userID, reason)
+		return fmt.Sprintf("Rotated the secret of %v.", userID), err
+
+	case "revoke":
+		err := s.storage.RevokeSecret(secretFromInput(r.PostFormValue("secret")), reason)
+		return "Revoked the secret.", err
+
+	case "suspend":
+		err := s.storage.SuspendUser(userID, reason)
+		return fmt.Sprintf("Suspended %v.", userID), err
+
+	case "end-sessions":
+		err := s.storage.DeleteUserSessions(userID)
+		return fmt.Sprintf("Logged %v out everywhere.", userID), err
+
+	case "unsuspend":
+		err := s.storage.UnsuspendUser(userID)
+		return fmt.Sprintf("Unsuspended %v.", userID), err
+
+	case "role":
+		role := r.PostFormValue("role")
+		if userID == admin.ID && role != pp.RoleAdmin {
+			return "You can't remove your own admin role.", nil
+		}
+		err := s.storage.SetRole(userID, role)
+		return fmt.Sprintf("Set the role of %v to %v.", userID, role), err
+
+	case "grant-channel":
+		channel := r.PostFormValue("channel")
+		if _, ok := s.getChannel(channel); !ok || channel == "" {
+			return fmt.Sprintf("Channel %q does not exist.", channel), nil
+		}
+		err := s.storage.GrantChannel(userID, channel)
+		return fmt.Sprintf("Granted %v access to %v.", userID, channel), err
+
+	case "revoke-channel":
+		channel := r.PostFormValue("channel")
+		err := s.storage.RevokeChannel(userID, channel)
+		return fmt.Sprintf("Revoked the access of %v to %v.", userID, channel), err
+
+	case "add-rule":
+		rule, err := pp.NormalizeAccessRule(r.PostFormValue("rule"))
+		if err != nil {
+			return err.Error(), nil
+		}
+		err = s.storage.AddAccessRule(rule)
+		return fmt.Sprintf("Added access rule %v.", rule), err
+
+	case "remove-rule":
+		rule := r.PostFormValue("rule")
+		err := s.storage.RemoveAccessRule(rule)
+		return fmt.Sprintf("Removed access rule %v.", rule), err
+	}
+
+	return fmt.Sprintf("Unknown action %q.", action), nil
+}
+
+// handleCalendar serves the iCalendar feed of the scheduled episodes of every
+// channel to admins. Like the feeds it's authenticated with the secret of the
+// user, so that calendar applications can subscribe to it.
+func (s *server) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, secret, ok := s.handleSecret(w, r)
+	if !ok {
+		return
+	}
+
+	user, _, err := s.storage.UserBySecret(secret)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	if user.Role != pp.RoleAdmin {
+		s.logger(r).Warn("user tried to access the calendar", "user", userID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	err = s.writeCalendar(w, s.getChannels())
+	if err != nil {
+		s.logger(r).Warn("failed to write calendar to response", "error", err)
+	}
+}
+
+func (s *server) handleAdmin() http.HandlerFunc {
+	tmplCompiled := template.Must(template.New("admin").Funcs(template.FuncMap{
+		"date": func(t time.Time) string {
+			if t.IsZero() {
+				return "never"
+			}
+			return t.Format("2006-01-02 15:04")
+		},
+	}).Parse(tmplAdmin))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, secret, sessionID, ok, err := s.sessionUser(r)
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Redirect(w, r, loginURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+			return
+		}
+		if admin.Role != pp.RoleAdmin {
+			s.logger(r).Warn("user tried to access the admin pages", "user", admin.ID)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var message string
+		if r.Method == http.MethodPost {
+			// the session cookie is sent along with the forms of other sites too
+			if !s.validCSRFToken(r.PostFormValue("csrf"), sessionID) {
+				s.logger(r).Warn("admin action without a valid CSRF token", "admin", admin.ID)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			message, err = s.handleAdminAction(admin, r)
+			if err != nil {
+				s.logger(r).Error("admin action failed", "error", err)
+				message = fmt.Sprintf("Failed: %v", err)
+			}
+
+			// redirect so that reloading the page doesn't repeat the action
+			http.Redirect(w, r, "/admin?"+url.Values{"message": {message}}.Encode(), http.StatusSeeOther)
+			return
+		}
+		message = r.URL.Query().Get("message")
+
+		users, err := s.storage.Users()
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		type user struct {
+			pp.UserStatus
+			Channels []string
+		}
+		us := make([]user, 0, len(users))
+		for _, u := range users {
+			channels, err := s.storage.UserChannels(u.ID)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+			us = append(us, user{u, channels})
+		}
+
+		restricted := make([]string, 0)
+		for _, c := range s.getChannels() {
+			if c.restricted {
+				restricted = append(restricted, c.id)
+			}
+		}
+
+		rules, err := s.storage.AccessRules()
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		episodes, err := s.storage.EpisodeStats()
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		clients, err := s.storage.FeedClients()
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		type scheduled struct {
+			Channel, Key       string
+			Published, Expires time.Time
+		}
+		var upcoming []scheduled
+		for _, c := range s.getChannels() {
+			for _, p := range c.getScheduled() {
+				pd := p.Details()
+				upcoming = append(upcoming, scheduled{c.id, pd.Key, pd.Published, pd.Expires})
+			}
+		}
+
+		var flagged []flaggedSecret
+		if s.leaks != nil {
+			flagged = s.leaks.getFlagged()
+		}
+
+		csrfToken, err := s.csrfToken(sessionID)
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		err = tmplCompiled.Execute(w, struct {
+			Message            string
+			Flagged            []flaggedSecret
+			Users              []user
+			RestrictedChannels []string
+			EnforceACL         bool
+			AccessRules        []string
+			Episodes           []pp.EpisodeStats
+			FeedClients        []pp.FeedClient
+			Scheduled          []scheduled
+			CalendarURL        string
+			CSRFToken          string
+		}{message, flagged, us, restricted, s.enforceACL, rules, episodes, clients, upcoming, s.baseURL + "/calendar?" + url.Values{"s": {secret}}.Encode(), csrfToken})
+		if err != nil {
+			s.logger(r).Error("failed to render admin", "error", err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+const notAllowedMessage = "You are not allowed to access this site, ask an administrator for access."
+
+// authStateCookie is the name of the cookie that stores the authState of a
+// login that is in progress, the cookie is only sent to /auth.
+const authStateCookie = "podcast_auth"
+
+// authStateMaxAge is how long the user has time to log in with the provider.
+const authStateMaxAge = 10 * time.Minute
+
+// authState is the state of a single login, it's stored in a signed cookie
+// while the user logs in with the provider.
+type authState struct {
+	// State is compared to the state the provider returns, this makes sure
+	// the login was started by the same browser that finishes it (CSRF)
+	State string `json:"s"`
+	// CodeVerifier is the PKCE code verifier of the login
+	CodeVerifier string `json:"v"`
+	// Next is the local path the user is redirected to after logging in
+	Next string `json:"n"`
+}
+
+// sessionCookie is the name of the cookie that stores the session of a
+// logged in user, the session itself is stored in the storage.
+const sessionCookie = "podcast_session"
+
+// localPath returns p if it's a path on this site and "/" otherwise, this way
+// the next parameter can't be used to redirect users to other sites.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+
+	u, err := url.Parse(p)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+
+	return p
+}
+
+// loginURL returns the URL that starts the login and returns to next afterwards.
+func loginURL(next string) string {
+	return "/auth?" + url.Values{"next": {localPath(next)}}.Encode()
+}
+
+func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if providerErr := q.Get("error"); providerErr != "" {
+		s.logger(r).Warn("auth provider returned an error", "error", providerErr, "description", q.Get("error_description"))
+		http.Error(w, "Logging in failed, please try again.", http.StatusForbidden)
+		return
+	}
+
+	code := q.Get("code")
+	if code == "" {
+		s.handleAuthStart(w, r, localPath(q.Get("next")))
+		return
+	}
+
+	var state authState
+	c, err := r.Cookie(authStateCookie)
+	if err == nil {
+		err = s.cookies.decode(c.Value, &state)
+	}
+	if err != nil || state.State == "" || subtle.ConstantTimeCompare([]byte(state.State), []byte(q.Get("state"))) != 1 {
+		s.logger(r).Warn("invalid auth state", "error", err)
+		http.Error(w, "Invalid or expired login, please try again.", http.StatusBadRequest)
+		return
+	}
+
+	// the state can only be used once
+	http.SetCookie(w, &http.Cookie{Name: authStateCookie, Path: "/auth", MaxAge: -1})
+
+	identity, err := s.auth.Identify(r.Context(), code, state.CodeVerifier)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	ok, err := s.userAllowed(identity.UserID, identity.HostedDomain)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	if !ok {
+		s.logger(r).Info("user is not allowed by the access rules", "user", identity.UserID, "hosted_domain", identity.HostedDomain)
+		http.Error(w, notAllowedMessage, http.StatusForbidden)
+		return
+	}
+
+	secret, err := s.storage.CreateUser(identity.UserID, identity.HostedDomain)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	user, ok, err := s.storage.UserBySecret(secret)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	if !ok || user.Suspended {
+		s.logger(r).Info("user is suspended", "user", identity.UserID, "reason", user.SuspendedReason)
+		http.Error(w, notAllowedMessage, http.StatusForbidden)
+		return
+	}
+
+	err = s.startSession(w, r, user.ID)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, localPath(state.Next), http.StatusTemporaryRedirect)
+}
+
+// handleAuthStart starts a new login by redirecting the user to the provider.
+func (s *server) handleAuthStart(w http.ResponseWriter, r *http.Request, next string) {
+	codeVerifier, codeChallenge := pp.GeneratePKCE()
+	state := authState{
+		State:        pp.GenerateSecret(),
+		CodeVerifier: codeVerifier,
+		Next:         next,
+	}
+
+	value, err := s.cookies.encode(state, time.Now().Add(authStateMaxAge))
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	// SameSite has to be Lax (instead of Strict) because the cookie must be sent
+	// when the provider redirects the user back to us
+	http.SetCookie(w, &http.Cookie{
+		Name:     authStateCookie,
+		Value:    value,
+		Path:     "/auth",
+		MaxAge:   int(authStateMaxAge.Seconds()),
+		Secure:   !*flagNoSecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	s.logger(r).Debug("redirecting user to authentication")
+	http.Redirect(w, r, s.auth.AuthURL(state.State, codeChallenge), http.StatusTemporaryRedirect)
+}
+
+// startSession creates a new session for the user and sets the session cookie.
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, userID string) error {
+	expires := time.Now().Add(s.sessionMaxAge)
+	value, err := s.storage.CreateSession(userID, r.UserAgent(), s.clientIP(r), expires)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Expires:  expires,
+		Secure:   !*flagNoSecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// endSession deletes the session of the request and its cookie.
+func (s *server) endSession(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, MaxAge: -1})
+
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	return s.storage.DeleteSessionByCookie(c.Value)
+}
+
+// csrfToken returns the token that the forms of the pages of the session
+// must submit. It's signed so that other sites can't forge it, and bound to
+// the session so that a token of another session isn't accepted.
+func (s *server) csrfToken(sessionID string) (string, error) {
+	return s.cookies.encode("csrf:"+sessionID, time.Now().Add(s.sessionMaxAge))
+}
+
+// validCSRFToken returns whether token was returned by csrfToken for the session.
+func (s *server) validCSRFToken(token, sessionID string) bool {
+	var value string
+	return s.cookies.decode(token, &value) == nil && value == "csrf:"+sessionID
+}
+
+// validForm returns whether the request is a POST of a form of a page of the
+// session, otherwise it writes the error response.
+func (s *server) validForm(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+
+	// the session cookie is sent along with the forms of other sites too
+	if !s.validCSRFToken(r.PostFormValue("csrf"), sessionID) {
+		s.logger(r).Warn("form without a valid CSRF token", "path", r.URL.Path, "action", r.URL.Query().Get("action"))
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// sessionUser returns the user of the session of the request, its secret and
+// the ID of the session, the returned bool is false if the request doesn't have
+// a valid session or if the user of the session isn't active anymore (in which
+// case it should be treated as not logged in).
+func (s *server) sessionUser(r *http.Request) (pp.User, string, string, bool, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err == http.ErrNoCookie {
+		return pp.User{}, "", "", false, nil
+	}
+	if err != nil {
+		return pp.User{}, "", "", false, err
+	}
+
+	user, ok, err := s.storage.SessionUser(c.Value, s.sessionIdleTimeout)
+	if err != nil || !ok {
+		return pp.User{}, "", "", false, err
+	}
+
+	ok, err = s.userActive(user)
+	if err != nil || !ok {
+		return pp.User{}, "", "", false, err
+	}
+
+	secret, err := s.storage.UserSecret(user.ID)
+	if err != nil {
+		return pp.User{}, "", "", false, err
+	}
+
+	return user, secret, pp.SessionID(c.Value), true, nil
+}
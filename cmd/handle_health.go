@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// handleHealth responds as long as the process is able to serve requests.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReady responds with 503 if the storage can't be reached or the
+// podcasts of a channel couldn't be updated recently, the reasons are in the
+// body and the details in the log.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+
+	if pinger, ok := s.storage.(pp.Pinger); ok {
+		err := pinger.Ping()
+		if err != nil {
+			s.log.Warn("readiness: failed to reach the storage", "error", err)
+			problems = append(problems, "the storage can't be reached")
+		}
+	}
+
+	for _, c := range s.getChannels() {
+		updatedAt, failures, err := c.updateStatus()
+		switch {
+		case err != nil:
+			s.log.Warn("readiness: the podcasts of the channel failed to update", "channel", c.id, "error", err)
+			problems = append(problems, fmt.Sprintf("the last %v update(s) of channel %q failed", failures, c.id))
+		case updatedAt.IsZero():
+			problems = append(problems, fmt.Sprintf("channel %q hasn't been updated yet", c.id))
+		case s.refreshInterval > 0 && time.Since(updatedAt) > 3*s.refreshInterval:
+			problems = append(problems, fmt.Sprintf("channel %q was last updated at %v", c.id, updatedAt.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, problem := range problems {
+			fmt.Fprintln(w, problem)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// handleMetricsPage serves the metrics in the Prometheus text format.
+func (s *server) handleMetricsPage(w http.ResponseWriter, r *http.Request) {
+	if s.metricsToken != "" {
+		expected := "Bearer " + s.metricsToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+}
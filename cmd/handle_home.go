@@ -2,9 +2,11 @@ package main
 
 import (
 	"html/template"
-	"log"
 	"net/http"
 	"net/url"
+	"strings"
+
+	"github.com/polarpayne/pp"
 )
 
 var tmpl = `
@@ -15,10 +17,10 @@ var tmpl = `
 	<meta name="viewport" content="width=device-width, initial-scale=1.0">
 	<link rel="shortcut icon" href="/logo">
 
-	{{ if .NotLoggedIn }}
-	<title>Private Podcast</title>
-	{{ else }}
+	{{ if .Name }}
 	<title>Private Podcast - {{ .Name }}</title>
+	{{ else }}
+	<title>Private Podcast</title>
 	{{ end }}
 
 	<style>
@@ -27,7 +29,7 @@ var tmpl = `
 			font-family: sans-serif;
 		}
 
-		audio {
+		audio, video {
 			width: 100%;
 		}
 
@@ -68,11 +70,44 @@ var tmpl = `
 			margin-top: 2rem;
 		}
 
+		.artwork {
+			float: right;
+			margin-left: 1rem;
+			max-width: 80px;
+		}
+
+		.podcast-info {
+			font-size: 90%;
+			margin-top: -0.5rem;
+		}
+
+		.chapters {
+			padding-left: 1.5rem;
+		}
+
+		.chapters a[data-start] {
+			font-family: monospace;
+		}
+
+		.caption {
+			min-height: 1.5em;
+			font-style: italic;
+			white-space: pre-line;
+		}
+
+		.transcripts {
+			font-size: 90%;
+		}
+
 		.podcast-description {
 			white-space: pre-line;
 			margin: 0;
 		}
 
+		.logout {
+			display: inline;
+		}
+
 		.footer {
 			font-size: 75%;
 			margin-top: 2rem;
@@ -84,37 +119,122 @@ var tmpl = `
 	<div class="content">
 
 {{ if .NotLoggedIn }}
-	<a href="/?action=login">login</a>
+	<a href="{{ .LoginURL }}">login</a>
 	{{ else }}
-	<a href="/?action=logout">logout</a>
+	<form method="post" action="/?action=logout" class="logout">
+		<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+		<button type="submit">logout</button>
+	</form>
+	{{ if .Admin }}<a href="/admin">admin</a>{{ end }}
 {{ end }}
 
 {{ if not .NotLoggedIn }}
+	<p>Every podcast below has its own private feed URL. <span class="alert">DO NOT SHARE THEM WITH ANYONE.</span> We track all requests.</p>
+	<p>The URLs should work with pretty much any podcast application that supports custom URLs (at least <a href="https://www.videolan.org/vlc/">VLC</a> and <a href="https://overcast.fm/">Overcast</a> are known to work), just <span class="alert">DON'T SHARE THEM</span>.</p>
+
+	{{ range .Channels }}
+	<hr>
+
+	<div class="channel">
 	<div class="top">
-		<img src="/logo" class="logo">
+		<img src="{{ .LogoURL }}" class="logo">
 		<h1>{{ .Name }}</h1>
 		<p class="description">{{ .Description }}</p>
 	</div>
 
-	<hr>
-
-	<p>The following URL is your private podcast feed. <span class="alert">DO NOT SHARE IT WITH ANYONE.</span> We track all requests.</p>
 	<p class="url"><a href="{{ .FeedURL }}">{{ .FeedURL }}</a></p>
-	<p>This URL should work with pretty much any podcast application that supports custom URLs (at least <a href="https://www.videolan.org/vlc/">VLC</a> and <a href="https://overcast.fm/">Overcast</a> are known to work), just <span class="alert">DON'T SHARE IT</span>.</p>
-
-	<hr>
 
 	<h2>Episodes</h2>
 
+	{{ if $.Episode }}
+	<p><a href="/">show all episodes</a></p>
+	{{ end }}
+
 	{{ range .Podcasts }}
 	<div class="podcast">
-		<h3>{{ .Title }} ({{ .Published }})</h3>
-		<audio controls src="{{ .URL }}">Your browser does not support the <code>audio</code> element.</audio>
+		{{ if .ArtworkURL }}<img src="{{ .ArtworkURL }}" class="artwork">{{ end }}
+		<h3><a href="{{ .Link }}">{{ .Title }}</a> ({{ .Published }})</h3>
+		{{ if or .Artist .Season .Episode .Duration .Explicit }}
+		<p class="podcast-info">
+			{{ if .Artist }}{{ .Artist }}{{ end }}
+			{{ if .Season }}Season {{ .Season }}{{ end }}
+			{{ if .Episode }}Episode {{ .Episode }}{{ end }}
+			{{ if .Duration }}{{ .Duration }}{{ end }}
+			{{ if .Explicit }}<strong>explicit</strong>{{ end }}
+		</p>
+		{{ end }}
+		{{ if .Video }}
+		<video controls preload="none" src="{{ .URL }}">
+			{{ if .CaptionsURL }}<track kind="captions" src="{{ .CaptionsURL }}" label="Captions" default>{{ end }}
+			Your browser does not support the <code>video</code> element.
+		</video>
+		{{ else }}
+		<audio controls preload="none" src="{{ .URL }}">
+			{{ if .CaptionsURL }}<track kind="captions" src="{{ .CaptionsURL }}" label="Captions" default>{{ end }}
+			Your browser does not support the <code>audio</code> element.
+		</audio>
+		{{ if .CaptionsURL }}<p class="caption"></p>{{ end }}
+		{{ end }}
+		{{ if .Transcripts }}
+		<p class="transcripts">Transcript: {{ range .Transcripts }}<a href="{{ .URL }}">{{ .Format }}</a> {{ end }}</p>
+		{{ end }}
 		{{ if .Description }}
 		<p class="podcast-description">{{ .Description }}</p>
 		{{ end }}
+		{{ if .Chapters }}
+		<ol class="chapters">
+			{{ range .Chapters }}
+			<li><a href="#" data-start="{{ .Seconds }}">{{ .Start }}</a> {{ if .URL }}<a href="{{ .URL }}">{{ .Title }}</a>{{ else }}{{ .Title }}{{ end }}</li>
+			{{ end }}
+		</ol>
+		{{ end }}
 	</div>
 	{{ end }}
+	</div>
+	{{ else }}
+	<hr>
+
+	<p>You don't have access to any podcasts yet.</p>
+	{{ end }}
+
+	<hr>
+
+	<h2>Feed URLs</h2>
+	<p>If your feed URLs have leaked, regenerate them. The old URLs stop working immediately and you have to update the URLs in your podcast applications.</p>
+	<form method="post" action="/?action=rotate">
+		<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+		<input type="text" name="reason" placeholder="Reason (optional)">
+		<button type="submit">Regenerate my feed URLs</button>
+	</form>
+
+	{{ if .SecretHistory }}
+	<h3>Revoked feed URLs</h3>
+	<ul>
+		{{ range .SecretHistory }}
+		<li>Revoked {{ .RevokedAt.Format "2006-01-02 15:04" }} (created {{ .CreatedAt.Format "2006-01-02" }}): {{ .Reason }}</li>
+		{{ end }}
+	</ul>
+	{{ end }}
+
+	<h2>Sessions</h2>
+	<p>You are logged in on the following devices, log out the ones you don't recognize. This doesn't affect your feed URLs.</p>
+	<ul>
+		{{ range .Sessions }}
+		<li>
+			<form method="post" action="/?action=end-session">
+				<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+				<input type="hidden" name="session" value="{{ .ID }}">
+				{{ .UserAgent }} ({{ .ClientIP }}), logged in {{ .CreatedAt.Format "2006-01-02 15:04" }}, last seen {{ .LastSeen.Format "2006-01-02 15:04" }}
+				{{ if eq .ID $.SessionID }}<strong>this device</strong>{{ else }}<button type="submit">log out</button>{{ end }}
+			</form>
+		</li>
+		{{ end }}
+	</ul>
+	<form method="post" action="/?action=end-session">
+		<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+		<input type="hidden" name="all" value="1">
+		<button type="submit">Log out everywhere</button>
+	</form>
 
 {{ end }}
 
@@ -127,6 +247,33 @@ var tmpl = `
 	</p>
 
 	</div>
+
+	<script>
+		// the start of a chapter seeks the player of its episode
+		document.addEventListener("click", function(e) {
+			var link = e.target.closest("a[data-start]");
+			if (!link) {
+				return;
+			}
+			e.preventDefault();
+
+			var player = link.closest(".podcast").querySelector("audio, video");
+			player.currentTime = parseFloat(link.dataset.start);
+			player.play();
+		});
+
+		// audio elements don't show captions, the current cue is shown below
+		// the player instead
+		document.querySelectorAll("audio track").forEach(function(track) {
+			var caption = track.closest(".podcast").querySelector(".caption");
+			track.track.mode = "hidden";
+			track.track.addEventListener("cuechange", function() {
+				caption.textContent = Array.prototype.map.call(this.activeCues, function(cue) {
+					return cue.text;
+				}).join("\n");
+			});
+		});
+	</script>
 </body>
 `
 
@@ -134,59 +281,225 @@ func (s *server) handleHome() http.HandlerFunc {
 	tmplCompiled := template.Must(template.New("home").Parse(tmpl))
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("podcast_session")
-		if err != nil && err != http.ErrNoCookie {
+		user, secret, sessionID, loggedIn, err := s.sessionUser(r)
+		if err != nil {
 			s.handleError(w, r, err)
 			return
 		}
+		sessionCookieNotSet := !loggedIn
+		userID := user.ID
 
-		sessionCookieNotSet := err == http.ErrNoCookie
-		var secret string
-		if !sessionCookieNotSet {
-			secret = c.Value
-		}
 		action := r.URL.Query().Get("action")
 
 		switch action {
 		case "login":
-			http.Redirect(w, r, "/auth", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, loginURL(r.URL.Query().Get("next")), http.StatusTemporaryRedirect)
 			return
 
 		case "logout":
-			http.SetCookie(w, &http.Cookie{Name: "podcast_session", MaxAge: -1})
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			// without a session there is nothing to protect, the cookie is just cleared
+			if loggedIn && !s.validForm(w, r, sessionID) {
+				return
+			}
+
+			err = s.endSession(w, r)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		q := url.Values{}
-		q.Set("s", secret)
-		feedURL := s.baseURL + "/feed?" + q.Encode()
+		if action == "rotate" && !sessionCookieNotSet {
+			if !s.validForm(w, r, sessionID) {
+				return
+			}
+
+			reason := strings.TrimSpace(r.PostFormValue("reason"))
+			if reason == "" {
+				reason = "regenerated by the user"
+			}
 
+			_, err = s.storage.RotateSecret(userID, reason)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if action == "end-session" && !sessionCookieNotSet {
+			if !s.validForm(w, r, sessionID) {
+				return
+			}
+
+			if r.PostFormValue("all") != "" {
+				err = s.storage.DeleteUserSessions(userID)
+			} else {
+				err = s.storage.DeleteSession(userID, r.PostFormValue("session"))
+			}
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		// a link to a single episode shows only that episode, the link
+		// survives logging in (see loginURL) so that it can be shared
+		episode := r.URL.Query().Get("n")
+
+		type chapter struct {
+			// Start is formatted for showing it, Seconds for seeking
+			Start      string
+			Seconds    float64
+			Title, URL string
+		}
+		type transcript struct {
+			Format, URL string
+		}
 		type p struct {
 			Title       string
 			Description string
 			URL         string
+			Link        string
 			Published   string
+			// ArtworkURL is only set if the episode has its own artwork
+			ArtworkURL      string
+			Artist          string
+			Season, Episode int
+			Duration        string
+			Explicit        bool
+			Video           bool
+			Chapters        []chapter
+			// CaptionsURL is the WebVTT transcript for <track>, if the
+			// episode has a transcript with timestamps
+			CaptionsURL string
+			Transcripts []transcript
+		}
+		type ch struct {
+			Name, Description string
+			LogoURL, FeedURL  string
+			Podcasts          []p
+		}
+
+		channels := make([]ch, 0)
+		var secretHistory []pp.SecretEvent
+		var sessions []pp.Session
+		if !sessionCookieNotSet {
+			secretHistory, err = s.storage.SecretHistory(userID)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+
+			sessions, err = s.storage.Sessions(userID)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+
+			cs, err := s.userChannels(userID)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+
+			for _, c := range cs {
+				podcasts := make([]p, 0)
+				for _, podcast := range c.getPodcasts() {
+					pd := podcast.Details()
+					if episode != "" && pd.Key != episode {
+						continue
+					}
+
+					q := url.Values{}
+					q.Set("n", pd.Key)
+					pURL := s.channelURL("/podcast", c, secret, q)
+					link := "/?" + q.Encode()
+					var artworkURL, duration string
+					if pd.Artwork != "" || pd.EmbeddedArtwork != nil {
+						artworkURL = s.artworkURL(c, secret, pd)
+					}
+					if pd.Duration > 0 {
+						duration = formatDuration(pd.Duration)
+					}
+					episodeNumber := pd.Episode
+					if episodeNumber == 0 {
+						episodeNumber = pd.Track
+					}
+					chapters := make([]chapter, 0, len(pd.Chapters))
+					for _, c := range pd.Chapters {
+						chapters = append(chapters, chapter{formatDuration(c.Start), c.Start.Seconds(), c.Title, c.URL})
+					}
+					var captionsURL string
+					transcripts := make([]transcript, 0, len(pd.Transcripts))
+					for _, t := range pd.Transcripts {
+						tq := url.Values{}
+						tq.Set("n", pd.Key)
+						tq.Set("t", t.Format())
+						transcripts = append(transcripts, transcript{t.Format(), s.channelURL("/transcript", c, secret, tq)})
+						if t.Format() != "txt" && captionsURL == "" {
+							// SubRip is converted to WebVTT by handleTranscript
+							tq.Set("t", "vtt")
+							captionsURL = s.channelURL("/transcript", c, secret, tq)
+						}
+					}
+					podcasts = append(podcasts, p{
+						pd.Title, pd.Description, pURL, link, pd.Published.Format("2006-01-02"),
+						artworkURL, pd.Artist, pd.Season, episodeNumber, duration, pd.Explicit,
+						pp.IsVideo(contentType(pd)), chapters, captionsURL, transcripts,
+					})
+				}
+				if episode != "" && len(podcasts) == 0 {
+					continue
+				}
+
+				channels = append(channels, ch{
+					c.name, c.description,
+					s.channelURL("/logo", c, "", nil), s.channelURL("/feed", c, secret, nil),
+					podcasts,
+				})
+			}
+		}
+
+		// with exactly one channel the page is titled after it, like it was before channels
+		var name string
+		if len(channels) == 1 {
+			name = channels[0].Name
 		}
-		podcasts := make([]p, 0)
-		for _, podcast := range s.getPodcasts() {
-			pd := podcast.Details()
 
-			q = url.Values{}
-			q.Set("s", secret)
-			q.Set("n", pd.Key)
-			pURL := s.baseURL + "/podcast?" + q.Encode()
-			podcasts = append(podcasts, p{pd.Title, pd.Description, pURL, pd.Published.Format("2006-01-02")})
+		var csrfToken string
+		if loggedIn {
+			csrfToken, err = s.csrfToken(sessionID)
+			if err != nil {
+				s.handleError(w, r, err)
+				return
+			}
 		}
 
 		err = tmplCompiled.Execute(w, struct {
-			Secret, FeedURL         string
-			NotLoggedIn             bool
-			Name, Description, Help string
-			Podcasts                []p
-		}{secret, feedURL, sessionCookieNotSet, s.name, s.description, s.helpText, podcasts})
+			NotLoggedIn   bool
+			LoginURL      string
+			Admin         bool
+			Name, Help    string
+			Episode       string
+			Channels      []ch
+			SecretHistory []pp.SecretEvent
+			Sessions      []pp.Session
+			SessionID     string
+			CSRFToken     string
+		}{
+			sessionCookieNotSet, loginURL(r.URL.RequestURI()), user.Role == pp.RoleAdmin,
+			name, s.getHelpText(), episode, channels, secretHistory, sessions, sessionID, csrfToken,
+		})
 		if err != nil {
-			log.Printf("failed to render home: %v", err)
+			s.logger(r).Error("failed to render home", "error", err)
 		}
 	}
 }
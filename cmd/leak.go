@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// actions that the leak detector can take when a secret looks leaked
+const (
+	leakActionLog     = "log"
+	leakActionRotate  = "rotate"
+	leakActionSuspend = "suspend"
+)
+
+// flaggedSecret is a secret that the leak detector found to look leaked.
+type flaggedSecret struct {
+	UserID  string
+	Reasons []string
+	Action  string
+	At      time.Time
+}
+
+// leakDetector periodically checks the activity of every secret and flags the
+// secrets whose activity looks like the secret has been shared with others.
+type leakDetector struct {
+	window     time.Duration
+	thresholds pp.LeakThresholds
+	action     string
+
+	log pp.Logger
+
+	flaggedMutex sync.RWMutex
+	flagged      []flaggedSecret
+}
+
+func newLeakDetector(window time.Duration, thresholds pp.LeakThresholds, action string, logger pp.Logger) (*leakDetector, error) {
+	switch action {
+	case leakActionLog, leakActionRotate, leakActionSuspend:
+	default:
+		return nil, fmt.Errorf("invalid leak action %q (expected one of %q, %q or %q)", action, leakActionLog, leakActionRotate, leakActionSuspend)
+	}
+
+	return &leakDetector{window: window, thresholds: thresholds, action: action, log: logger}, nil
+}
+
+// detect checks the activity of all secrets during the window and takes the
+// configured action on the ones that look leaked. A failure to act on one
+// secret doesn't stop the others from being acted on.
+func (d *leakDetector) detect(storage pp.Storage) error {
+	activities, err := storage.SecretActivity(time.Now().Add(-d.window))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	flagged := make([]flaggedSecret, 0)
+	var failed []string
+	for _, a := range activities {
+		reasons := d.thresholds.Check(a)
+		if len(reasons) == 0 {
+			continue
+		}
+
+		reason := "looks leaked: " + strings.Join(reasons, ", ")
+		d.log.Warn("leak detector: the secret of a user looks leaked", "user", a.UserID, "reasons", reasons, "action", d.action)
+
+		action := d.action
+		switch d.action {
+		case leakActionRotate:
+			_, err = storage.RotateSecret(a.UserID, "automatically rotated, "+reason)
+		case leakActionSuspend:
+			err = storage.SuspendUser(a.UserID, "automatically suspended pending review, "+reason)
+		}
+		if err != nil {
+			d.log.Error("leak detector: failed to act on a secret that looks leaked", "user", a.UserID, "action", d.action, "error", err)
+			failed = append(failed, a.UserID)
+			action = "failed to " + d.action
+		}
+
+		flagged = append(flagged, flaggedSecret{a.UserID, reasons, action, now})
+	}
+
+	d.flaggedMutex.Lock()
+	d.flagged = flagged
+	d.flaggedMutex.Unlock()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to %v the secret(s) of user(s) %q", d.action, failed)
+	}
+
+	return nil
+}
+
+// getFlagged returns the secrets that were flagged the last time detect ran.
+func (d *leakDetector) getFlagged() []flaggedSecret {
+	d.flaggedMutex.RLock()
+	defer d.flaggedMutex.RUnlock()
+	return d.flagged
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/polarpayne/pp/pptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingStorage fails to rotate the secret of one user.
+type failingStorage struct {
+	*pptest.Storage
+	failUser string
+}
+
+func (s failingStorage) RotateSecret(userID, reason string) (string, error) {
+	if userID == s.failUser {
+		return "", errors.New("rotation failed")
+	}
+	return s.Storage.RotateSecret(userID, reason)
+}
+
+func TestLeakDetect(t *testing.T) {
+	assert := assert.New(t)
+	storage := failingStorage{pptest.NewStorage(), "alice@example.com"}
+
+	secrets := map[string]string{}
+	for _, userID := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		secret, err := storage.CreateUser(userID, "")
+		assert.NoError(err)
+		secrets[userID] = secret
+	}
+
+	// alice and bob share their secrets, carol only uses hers herself
+	for _, userID := range []string{"alice@example.com", "bob@example.com"} {
+		for _, ua := range []string{"a", "b", "c"} {
+			assert.NoError(storage.LogFeed(secrets[userID], "default", "", ua, "192.0.2.1"))
+		}
+	}
+	assert.NoError(storage.LogFeed(secrets["carol@example.com"], "default", "", "a", "192.0.2.1"))
+
+	d, err := newLeakDetector(time.Hour, pp.LeakThresholds{UserAgents: 2}, leakActionRotate, pp.Logger{})
+	assert.NoError(err)
+
+	// the failure to rotate the secret of alice doesn't stop bob's from being rotated
+	err = d.detect(storage)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "alice@example.com")
+	}
+
+	secret, err := storage.UserSecret("bob@example.com")
+	assert.NoError(err)
+	assert.NotEqual(secrets["bob@example.com"], secret)
+	secret, err = storage.UserSecret("carol@example.com")
+	assert.NoError(err)
+	assert.Equal(secrets["carol@example.com"], secret)
+
+	actions := map[string]string{}
+	for _, f := range d.getFlagged() {
+		actions[f.UserID] = f.Action
+	}
+	assert.Equal(map[string]string{"alice@example.com": "failed to rotate", "bob@example.com": "rotate"}, actions)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBuckets are the upper bounds (in seconds) of the histogram buckets,
+// the same as the defaults of the Prometheus client libraries.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricVec is a single metric with labels, either a counter, a gauge or a
+// histogram, in the Prometheus text format.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	// buckets is only used by histograms
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a metric for a single combination of label values.
+type series struct {
+	labelValues []string
+	value       float64
+	// counts is the number of observations in each bucket of a histogram
+	counts []uint64
+	count  uint64
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return newMetricVec(name, help, "counter", labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return newMetricVec(name, help, "gauge", labels...)
+}
+
+func newHistogram(name, help string, labels ...string) *metricVec {
+	m := newMetricVec(name, help, "histogram", labels...)
+	m.buckets = defaultBuckets
+	return m
+}
+
+// get returns the series of the label values, m.mutex must be held.
+func (m *metricVec) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %v has %v labels, got %v values", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to the counter (or gauge).
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.get(labelValues).value += v
+}
+
+// set sets the gauge to v.
+func (m *metricVec) set(v float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.get(labelValues).value = v
+}
+
+// observe adds an observation of d to the histogram.
+func (m *metricVec) observe(d time.Duration, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.get(labelValues)
+	v := d.Seconds()
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// escapeLabel escapes a label value like the Prometheus text format expects.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatLabels formats the labels of a series, extra is appended as is.
+func (m *metricVec) formatLabels(labelValues []string, extra string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, v := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, m.labels[i], escapeLabel(v)))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes the metric in the Prometheus text format, the series are
+// sorted by their label values. Nothing is written if there are no series.
+func (m *metricVec) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.series) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %v %v\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.kind)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", m.name, m.formatLabels(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, upper := range m.buckets {
+			le := fmt.Sprintf(`le="%v"`, formatFloat(upper))
+			fmt.Fprintf(w, "%v_bucket%v %v\n", m.name, m.formatLabels(s.labelValues, le), s.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", m.name, m.formatLabels(s.labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.name, m.formatLabels(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%v_count%v %v\n", m.name, m.formatLabels(s.labelValues, ""), s.count)
+	}
+}
+
+// metrics are the metrics of a server, they are served at /metrics.
+type metrics struct {
+	startTime time.Time
+
+	requests        *metricVec
+	requestDuration *metricVec
+	episodeBytes    *metricVec
+
+	refreshDuration     *metricVec
+	refreshErrors       *metricVec
+	refreshFailures     *metricVec
+	refreshLastSuccess  *metricVec
+	storageDuration     *metricVec
+	storageErrors       *metricVec
+	leakDetectionErrors *metricVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		startTime: time.Now(),
+
+		requests:        newCounter("pp_http_requests_total", "Number of HTTP requests by handler and status code.", "handler", "code"),
+		requestDuration: newHistogram("pp_http_request_duration_seconds", "Duration of the HTTP requests by handler.", "handler"),
+		episodeBytes:    newCounter("pp_episode_bytes_total", "Bytes of episodes streamed to the clients.", "channel", "episode"),
+
+		refreshDuration:     newHistogram("pp_refresh_duration_seconds", "Duration of listing the podcasts of a channel from its backend.", "channel"),
+		refreshErrors:       newCounter("pp_refresh_errors_total", "Number of failed updates of the podcasts of a channel.", "channel"),
+		refreshFailures:     newGauge("pp_refresh_consecutive_failures", "Number of updates of the podcasts of a channel that have failed since the last successful one.", "channel"),
+		refreshLastSuccess:  newGauge("pp_refresh_last_success_timestamp_seconds", "Unix time of the last successful update of the podcasts of a channel.", "channel"),
+		storageDuration:     newHistogram("pp_storage_query_duration_seconds", "Duration of the storage (database) calls by method.", "method"),
+		storageErrors:       newCounter("pp_storage_errors_total", "Number of failed storage (database) calls by method.", "method"),
+		leakDetectionErrors: newCounter("pp_leak_detection_errors_total", "Number of failed runs of the leak detector."),
+	}
+}
+
+// write writes all metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP pp_start_time_seconds Unix time when the server was started.\n")
+	fmt.Fprintf(w, "# TYPE pp_start_time_seconds gauge\n")
+	fmt.Fprintf(w, "pp_start_time_seconds %v\n", m.startTime.Unix())
+
+	for _, vec := range []*metricVec{
+		m.requests, m.requestDuration, m.episodeBytes,
+		m.refreshDuration, m.refreshErrors, m.refreshFailures, m.refreshLastSuccess,
+		m.storageDuration, m.storageErrors, m.leakDetectionErrors,
+	} {
+		vec.write(w)
+	}
+}
+
+// metricsWriter records the status code and the number of bytes written to a
+// response.
+type metricsWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
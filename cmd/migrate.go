@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/polarpayne/pp"
+)
+
+const migrateUsage = "usage: pp [flags] migrate up|down|status"
+
+// runMigrate runs the migrate command, which applies, reverts or lists the
+// migrations of the database in db-conn.
+func runMigrate(args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+
+	storage, err := openStorage(*flagDBConn)
+	if err != nil {
+		return fmt.Errorf("failed to create storage: %v", err)
+	}
+	migrator, ok := storage.(pp.Migrator)
+	if !ok {
+		return errors.New("the storage does not support migrations")
+	}
+
+	switch args[0] {
+	case "up":
+		return migrator.MigrateUp()
+
+	case "down":
+		return migrator.MigrateDown()
+
+	case "status":
+		status, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		w := newTable(os.Stdout)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := "pending"
+			if !m.AppliedAt.IsZero() {
+				applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\n", m.Version, m.Name, applied)
+		}
+		return w.Flush()
+	}
+
+	return errors.New(migrateUsage)
+}
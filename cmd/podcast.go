@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"sort"
 	"time"
 
@@ -21,37 +21,144 @@ func (a podcastList) Less(i, j int) bool {
 	return rhs.Published.Before(lhs.Published)
 }
 
+// updatePodcasts updates the podcasts of every channel, a failure to update one
+// channel doesn't stop the others from being updated.
 func (s *server) updatePodcasts() error {
-	log.Printf("updating podcasts")
+	var failed []string
+	for _, c := range s.getChannels() {
+		err := s.updateChannel(c)
+		if err != nil {
+			s.log.Error("failed to update podcasts", "channel", c.id, "error", err)
+			failed = append(failed, c.id)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to update podcasts of channel(s) %q", failed)
+	}
+
+	return nil
+}
+
+// updateChannel updates the podcasts of the channel and records the update in
+// the metrics. A panic while updating (e.g. while parsing a file of the
+// backend) is a failed update, it doesn't crash the process.
+func (s *server) updateChannel(c *channel) error {
+	start := time.Now()
+	err := c.safeUpdatePodcasts(s.log)
+	s.metrics.refreshDuration.observe(time.Since(start), c.id)
 
-	ps, err := s.backend.ListPodcasts()
+	updatedAt, failures, _ := c.updateStatus()
+	s.metrics.refreshFailures.set(float64(failures), c.id)
 	if err != nil {
+		s.metrics.refreshErrors.add(1, c.id)
 		return err
 	}
 
-	s.podcastsMutex.Lock()
-	defer s.podcastsMutex.Unlock()
+	s.metrics.refreshLastSuccess.set(float64(updatedAt.Unix()), c.id)
+	return nil
+}
 
-	log.Printf("updating podcasts: found %v podcasts", len(ps))
-	s.podcasts = make([]pp.Podcast, 0, len(ps))
+// safeUpdatePodcasts calls updatePodcasts and turns a panic into an error.
+func (c *channel) safeUpdatePodcasts(logger pp.Logger) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while updating podcasts: %v", r)
 
+			c.podcastsMutex.Lock()
+			defer c.podcastsMutex.Unlock()
+			c.updateErr = err
+			c.failures++
+		}
+	}()
+
+	return c.updatePodcasts(logger)
+}
+
+func (c *channel) updatePodcasts(logger pp.Logger) error {
+	logger = logger.With("channel", c.id)
+	logger.Debug("updating podcasts")
+
+	ps, err := c.backend.ListPodcasts()
+
+	c.podcastsMutex.Lock()
+	defer c.podcastsMutex.Unlock()
+
+	c.updateErr = err
+	if err != nil {
+		c.failures++
+		return err
+	}
+	c.updatedAt = time.Now()
+	c.failures = 0
+
+	logger.Info("updated podcasts", "podcasts", len(ps))
+	// the scheduled and expired podcasts are kept too, getPodcasts decides
+	// which of them are published
+	c.podcasts = make([]pp.Podcast, 0, len(ps))
 	now := time.Now()
 	for _, p := range ps {
 		pd := p.Details()
-		if now.Before(pd.Published) {
-			log.Printf("updating podcasts: skipping podcast with published date in the future title=%q published=%v", pd.Title, pd.Published)
+		if !pd.Expires.IsZero() && !now.Before(pd.Expires) {
+			logger.Debug("skipping expired podcast", "title", pd.Title, "expires", pd.Expires)
 			continue
 		}
-		s.podcasts = append(s.podcasts, p)
+		c.podcasts = append(c.podcasts, p)
 	}
 
-	sort.Sort(s.podcasts)
+	sort.Sort(c.podcasts)
 
 	return nil
 }
 
-func (s *server) getPodcasts() []pp.Podcast {
-	s.podcastsMutex.RLock()
-	defer s.podcastsMutex.RUnlock()
-	return s.podcasts
+// published returns true if the podcast is published at the time, it's
+// published from its published time until it expires.
+func published(pd pp.PodcastDetails, t time.Time) bool {
+	return !t.Before(pd.Published) && (pd.Expires.IsZero() || t.Before(pd.Expires))
+}
+
+// getPodcasts returns the podcasts that are published now. It's checked on
+// every call, so that scheduled podcasts appear (and expired ones disappear)
+// at the exact time and not only on the next update.
+func (c *channel) getPodcasts() []pp.Podcast {
+	c.podcastsMutex.RLock()
+	defer c.podcastsMutex.RUnlock()
+
+	now := time.Now()
+	out := make([]pp.Podcast, 0, len(c.podcasts))
+	for _, p := range c.podcasts {
+		if published(p.Details(), now) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// getScheduled returns the podcasts that are published in the future, the
+// next one first.
+func (c *channel) getScheduled() []pp.Podcast {
+	c.podcastsMutex.RLock()
+	defer c.podcastsMutex.RUnlock()
+
+	now := time.Now()
+	var out []pp.Podcast
+	for _, p := range c.podcasts {
+		if now.Before(p.Details().Published) {
+			out = append(out, p)
+		}
+	}
+
+	// c.podcasts is sorted with the latest first
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// updateStatus returns when the podcasts were last updated successfully, the
+// number of updates that have failed since then and the error of the latest.
+func (c *channel) updateStatus() (time.Time, int, error) {
+	c.podcastsMutex.RLock()
+	defer c.podcastsMutex.RUnlock()
+	return c.updatedAt, c.failures, c.updateErr
 }
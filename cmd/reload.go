@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// reloadableFlags are the settings that reloadSettings applies to the running
+// server, the others only take effect after a restart.
+var reloadableFlags = map[string]bool{
+	"config":         true,
+	"channels":       true,
+	"catalog-dir":    true,
+	"name":           true,
+	"description":    true,
+	"help-text":      true,
+	"backend-bucket": true,
+	"backend-dir":    true,
+	"backend-logo":   true,
+}
+
+// cloneFlag defines a flag like f in fs, with the same type and default.
+func cloneFlag(fs *flag.FlagSet, f *flag.Flag) error {
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		fs.Bool(f.Name, false, f.Usage)
+	case int64:
+		fs.Int64(f.Name, 0, f.Usage)
+	case time.Duration:
+		fs.Duration(f.Name, 0, f.Usage)
+	default:
+		fs.String(f.Name, "", f.Usage)
+	}
+
+	clone := fs.Lookup(f.Name)
+	clone.DefValue = f.DefValue
+	return clone.Value.Set(f.DefValue)
+}
+
+// reloadSettings loads the settings again like on startup and replaces the
+// channels (and their podcasts) and the help text of s. The running server
+// keeps its settings if the new ones are invalid.
+func reloadSettings(s *server) error {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err == nil {
+			err = cloneFlag(fs, f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	_, c, err := loadSettings(fs, os.Args[1:], os.LookupEnv, "config")
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		current := flag.Lookup(f.Name)
+		value := f.Value.String()
+		if value == current.Value.String() {
+			return
+		}
+		if !reloadableFlags[f.Name] {
+			logger.Warn("reload: a setting has changed, it only takes effect after a restart", "setting", f.Name)
+			return
+		}
+
+		previous[f.Name] = current.Value.String()
+		if err == nil {
+			err = current.Value.Set(value)
+		}
+	})
+
+	previousConfig := fileConfig
+	fileConfig = c
+
+	var channels []*channel
+	if err == nil {
+		channels, err = setupChannels()
+	}
+	if err == nil {
+		err = s.reload(*flagHelpText, channels)
+	}
+	if err != nil {
+		fileConfig = previousConfig
+		for name, value := range previous {
+			flag.Lookup(name).Value.Set(value)
+		}
+		return err
+	}
+
+	logger.Info("reloaded the configuration", "channels", len(channels))
+	return nil
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -12,72 +13,278 @@ import (
 type server struct {
 	mux *http.ServeMux
 
-	baseURL     string
-	name        string
-	description string
+	baseURL string
+	auth    pp.Auth
+	storage pp.Storage
+	// enforceACL makes only the users that are allowed by the access rules in
+	// storage able to log in and use their secrets
+	enforceACL bool
+
+	// reloadMutex guards the settings that are replaced when the configuration
+	// is reloaded, use getChannels and getHelpText to read them
+	reloadMutex sync.RWMutex
 	helpText    string
-	backend     pp.Backend
-	auth        pp.Auth
-	storage     pp.Storage
+	// channels is never empty, the first channel is the default channel
+	channels []*channel
+
+	// leaks is nil if leak detection is disabled
+	leaks *leakDetector
+
+	// cookies signs the cookies that must not be modified by the client
+	cookies signedCookie
 
-	podcasts      podcastList
-	podcastsMutex sync.RWMutex
+	// sessionMaxAge is how long a login lasts at most, sessionIdleTimeout is
+	// how long a session lasts without being used
+	sessionMaxAge      time.Duration
+	sessionIdleTimeout time.Duration
+
+	// log is the logger of everything that isn't a request, use logger(r) for
+	// the requests
+	log     pp.Logger
+	metrics *metrics
+	// metricsToken is the bearer token needed for /metrics, it's public if empty
+	metricsToken string
+	// behindProxy makes the client IPs be read from X-Forwarded-For
+	behindProxy bool
+	// refreshInterval is how often the podcasts are updated, it's zero until
+	// the server is started
+	refreshInterval time.Duration
 }
 
-func newServer(baseURL, name, description, helpText string, backend pp.Backend, auth pp.Auth, storage pp.Storage) *server {
+func newServer(baseURL, helpText string, channels []*channel, auth pp.Auth, storage pp.Storage, enforceACL bool, leaks *leakDetector, cookieKey []byte, sessionMaxAge, sessionIdleTimeout time.Duration, metricsToken string, behindProxy bool, logger pp.Logger) *server {
 	out := new(server)
 
 	out.baseURL = baseURL
-	out.name = name
-	out.description = description
 	out.helpText = helpText
+	out.enforceACL = enforceACL
+	out.leaks = leaks
+	out.cookies = signedCookie{cookieKey}
+	out.sessionMaxAge = sessionMaxAge
+	out.sessionIdleTimeout = sessionIdleTimeout
+	out.behindProxy = behindProxy
+
+	out.log = logger
+	out.metrics = newMetrics()
+	out.metricsToken = metricsToken
 
-	out.backend = backend
+	out.channels = channels
 	out.auth = auth
 	out.storage = storage
+	if storage != nil {
+		out.storage = metricsStorage{storage, out.metrics}
+	}
 
 	out.mux = http.NewServeMux()
 
-	out.mux.HandleFunc("/", out.handleHTTPToHTTPS(out.handleHome()))
+	out.mux.HandleFunc("/", out.handleRequest("home", out.handleHTTPToHTTPS(out.handleHome())))
+
+	out.mux.HandleFunc("/logo", out.handleRequest("logo", out.handleHTTPToHTTPS(out.handleLogo)))
+	out.mux.HandleFunc("/favicon.ico", out.handleRequest("logo", out.handleHTTPToHTTPS(out.handleLogo)))
 
-	out.mux.HandleFunc("/logo", out.handleHTTPToHTTPS(out.handleLogo))
-	out.mux.HandleFunc("/favicon.ico", out.handleHTTPToHTTPS(out.handleLogo))
+	out.mux.HandleFunc("/auth", out.handleRequest("auth", out.handleHTTPToHTTPS(out.handleAuth)))
+	out.mux.HandleFunc("/admin", out.handleRequest("admin", out.handleHTTPToHTTPS(out.handleAdmin())))
+	out.mux.HandleFunc("/calendar", out.handleRequest("calendar", out.handleHTTPToHTTPS(out.handleCalendar)))
 
-	out.mux.HandleFunc("/auth", out.handleHTTPToHTTPS(out.handleAuth))
+	out.mux.HandleFunc("/feed", out.handleRequest("feed", out.handleHTTPToHTTPS(out.handleFeed)))
+	out.mux.HandleFunc("/podcast", out.handleRequest("podcast", out.handleHTTPToHTTPS(out.handlePodcast)))
+	out.mux.HandleFunc("/artwork", out.handleRequest("artwork", out.handleHTTPToHTTPS(out.handleArtwork)))
+	out.mux.HandleFunc("/chapters", out.handleRequest("chapters", out.handleHTTPToHTTPS(out.handleChapters)))
+	out.mux.HandleFunc("/transcript", out.handleRequest("transcript", out.handleHTTPToHTTPS(out.handleTranscript)))
 
-	out.mux.HandleFunc("/feed", out.handleHTTPToHTTPS(out.handleFeed))
-	out.mux.HandleFunc("/podcast", out.handleHTTPToHTTPS(out.handlePodcast))
+	// the probes and metrics are requested by the infrastructure, which might
+	// not go through the proxy that terminates HTTPS
+	out.mux.HandleFunc("/healthz", out.handleHealth)
+	out.mux.HandleFunc("/readyz", out.handleReady)
+	out.mux.HandleFunc("/metrics", out.handleMetricsPage)
 
 	return out
 }
 
-func (s *server) start(addr string, updateInterval time.Duration) error {
+// start serves the podcasts on addr until ctx is done, after which the
+// requests in flight (e.g. episode downloads) get shutdownTimeout to finish.
+func (s *server) start(ctx context.Context, addr string, updateInterval, leakInterval, shutdownTimeout time.Duration) error {
 	err := s.updatePodcasts()
 	if err != nil {
 		return err
 	}
 
+	s.refreshInterval = updateInterval
+	go s.refreshPodcasts(ctx, updateInterval)
+	if s.leaks != nil {
+		go s.detectLeaks(ctx, leakInterval)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: s.mux}
+	errs := make(chan error, 1)
 	go func() {
-		var (
-			err      error
-			errCount int
-		)
-
-		ticker := time.NewTicker(updateInterval)
-		for range ticker.C {
-			err = s.updatePodcasts()
-			if err != nil {
-				if errCount >= 3 {
-					log.Panicf("failed to updated podcasts >3 times in a row: %v", err)
-				}
-				log.Printf("failed to update podcasts, error count = %v", errCount)
-				errCount++
-			} else {
-				errCount = 0
-			}
-		}
+		s.log.Info("starting server", "addr", addr)
+		errs <- srv.ListenAndServe()
 	}()
 
-	log.Printf("starting server... listening on %v", addr)
-	return http.ListenAndServe(addr, s.mux)
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.log.Info("shutting down, waiting for the requests in flight", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		return fmt.Errorf("failed to shut down gracefully: %v", err)
+	}
+
+	s.log.Info("server stopped")
+	return nil
+}
+
+// refreshPodcasts updates the podcasts every interval until ctx is done, the
+// podcasts of the last successful update are served while the updates fail.
+func (s *server) refreshPodcasts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var errCount int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.updatePodcasts()
+		if err != nil {
+			errCount++
+			s.log.Error("failed to update podcasts", "failures", errCount, "error", err)
+			continue
+		}
+		errCount = 0
+	}
+}
+
+// detectLeaks runs the leak detector every interval until ctx is done.
+func (s *server) detectLeaks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.leaks.detect(s.storage)
+		if err != nil {
+			s.metrics.leakDetectionErrors.add(1)
+			s.log.Error("failed to detect leaked secrets", "error", err)
+		}
+	}
+}
+
+// reload replaces the help text and the channels, the podcasts of the new
+// channels are updated before they are served. Nothing is replaced if the
+// podcasts of a channel can't be updated, its feed would be empty otherwise.
+func (s *server) reload(helpText string, channels []*channel) error {
+	for _, c := range channels {
+		err := s.updateChannel(c)
+		if err != nil {
+			return fmt.Errorf("failed to update podcasts of channel %v: %v", c.id, err)
+		}
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	s.helpText = helpText
+	s.channels = channels
+	return nil
+}
+
+func (s *server) getHelpText() string {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+	return s.helpText
+}
+
+func (s *server) getChannels() []*channel {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+	return s.channels
+}
+
+// getChannel returns the channel with the given id, an empty id refers to the
+// default channel (this keeps the URLs from before channels existed working).
+func (s *server) getChannel(id string) (*channel, bool) {
+	channels := s.getChannels()
+	if id == "" {
+		return channels[0], true
+	}
+
+	for _, c := range channels {
+		if c.id == id {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// userAllowed returns true if the user is allowed to log in and use their secret.
+func (s *server) userAllowed(userID, hostedDomain string) (bool, error) {
+	if !s.enforceACL {
+		return true, nil
+	}
+
+	return s.storage.UserAllowed(userID, hostedDomain)
+}
+
+// userActive returns true if the user is allowed to log in and isn't suspended.
+func (s *server) userActive(user pp.User) (bool, error) {
+	if user.Suspended {
+		return false, nil
+	}
+
+	return s.userAllowed(user.ID, user.HostedDomain)
+}
+
+// userChannels returns the channels that the user has access to.
+func (s *server) userChannels(userID string) ([]*channel, error) {
+	granted, err := s.storage.UserChannels(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	grantedSet := make(map[string]bool, len(granted))
+	for _, id := range granted {
+		grantedSet[id] = true
+	}
+
+	channels := s.getChannels()
+	out := make([]*channel, 0, len(channels))
+	for _, c := range channels {
+		if !c.restricted || grantedSet[c.id] {
+			out = append(out, c)
+		}
+	}
+
+	return out, nil
+}
+
+// hasAccess returns true if the user has access to the channel.
+func (s *server) hasAccess(userID string, c *channel) (bool, error) {
+	cs, err := s.userChannels(userID)
+	if err != nil {
+		return false, err
+	}
+
+	// the channels are compared by id since they are replaced on reload
+	for _, other := range cs {
+		if other.id == c.id {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
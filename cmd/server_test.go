@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/polarpayne/pp/pptest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBaseURL = "https://pp.example"
+
+type testServer struct {
+	*server
+	storage *pptest.Storage
+	auth    *pptest.Auth
+	backend *pptest.Backend
+}
+
+// newTestServer creates a server with a default channel that has two episodes
+// and a restricted channel "members" that has one.
+func newTestServer(t *testing.T) testServer {
+	backend := pptest.NewBackend([]byte("logo"),
+		pptest.NewPodcast(pp.PodcastDetails{
+			Key:       "2020-01-27 Hello World!.mp3",
+			Title:     "Hello World!",
+			Published: time.Date(2020, 1, 27, 0, 0, 0, 0, time.UTC),
+		}, []byte("0123456789")),
+		pptest.NewPodcast(pp.PodcastDetails{
+			Key:         "2020-02-03 Second.mp3",
+			Title:       "Second",
+			Published:   time.Date(2020, 2, 3, 0, 0, 0, 0, time.UTC),
+			Description: "The second episode",
+		}, []byte("abcdef")),
+	)
+	members := pptest.NewBackend([]byte("members logo"),
+		pptest.NewPodcast(pp.PodcastDetails{
+			Key:       "2020-01-01 Members Only.mp3",
+			Title:     "Members Only",
+			Published: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		}, []byte("secret stuff")),
+	)
+
+	channels := []*channel{
+		newChannel("default", "Test Podcast", "A podcast for testing", false, backend),
+		newChannel("members", "Members", "Only for members", true, members),
+	}
+
+	storage := pptest.NewStorage()
+	auth := pptest.NewAuth("https://auth.example/authorize")
+
+	s := newServer(testBaseURL, "", channels, auth, storage, false, nil, []byte("cookie key"), time.Hour, time.Hour, "metrics token", false, pp.Logger{})
+	if err := s.updatePodcasts(); err != nil {
+		t.Fatal(err)
+	}
+
+	return testServer{s, storage, auth, backend}
+}
+
+func (s testServer) do(r *http.Request) *http.Response {
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func (s testServer) get(target string) *http.Response {
+	return s.do(httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func (s testServer) createUser(t *testing.T, userID string) string {
+	secret, err := s.storage.CreateUser(userID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// login starts a session for the user and returns its cookie.
+func (s testServer) login(t *testing.T, userID string) *http.Cookie {
+	w := httptest.NewRecorder()
+	err := s.startSession(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return responseCookie(w.Result(), sessionCookie)
+}
+
+// post submits the form with the session cookie.
+func (s testServer) post(session *http.Cookie, target string, form url.Values) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(session)
+	return s.do(r)
+}
+
+// pageCSRFToken returns the CSRF token in the forms of the page for the session.
+func (s testServer) pageCSRFToken(t *testing.T, session *http.Cookie, target string) string {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.AddCookie(session)
+	body, _ := ioutil.ReadAll(s.do(r).Body)
+	match := csrfInput.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("no CSRF token in %v", target)
+	}
+	return string(match[1])
+}
+
+// csrfInput matches the CSRF token in the forms of a page.
+var csrfInput = regexp.MustCompile(`name="csrf" value="([^"]+)"`)
+
+func responseCookie(res *http.Response, name string) *http.Cookie {
+	for _, c := range res.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+type testFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Items []struct {
+			GUID struct {
+				IsPermaLink string `xml:"isPermaLink,attr"`
+				Value       string `xml:",chardata"`
+			} `xml:"guid"`
+			Title       string `xml:"title"`
+			Description string `xml:"description"`
+			Duration    string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+			Episode     int    `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+			Image       struct {
+				HREF string `xml:"href,attr"`
+			} `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+			Enclosure struct {
+				URL    string `xml:"url,attr"`
+				Length int64  `xml:"length,attr"`
+				Type   string `xml:"type,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+func TestFeed(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	res := s.get("/feed?s=" + secret)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var feed testFeed
+	assert.NoError(xml.NewDecoder(res.Body).Decode(&feed))
+	assert.Equal("Test Podcast", feed.Channel.Title)
+	if assert.Len(feed.Channel.Items, 2) {
+		// the latest episode is first
+		item := feed.Channel.Items[0]
+		assert.Equal("Second", item.Title)
+		assert.Equal("The second episode", item.Description)
+		assert.Equal(int64(6), item.Enclosure.Length)
+		assert.Equal("audio/mpeg", item.Enclosure.Type)
+		assert.Equal(testBaseURL+"/podcast?"+url.Values{"n": {"2020-02-03 Second.mp3"}, "s": {secret}}.Encode(), item.Enclosure.URL)
+		assert.Equal(pp.KeyGUID("2020-02-03 Second.mp3"), item.GUID.Value)
+		assert.Equal("false", item.GUID.IsPermaLink)
+
+		// the title is used when there's no description
+		assert.Equal("Hello World!", feed.Channel.Items[1].Description)
+	}
+
+	// the GUIDs don't change when the secret is rotated
+	newSecret, err := s.storage.RotateSecret("alice@example.com", "test")
+	assert.NoError(err)
+	var rotated testFeed
+	assert.NoError(xml.NewDecoder(s.get("/feed?s=" + newSecret).Body).Decode(&rotated))
+	if assert.Len(rotated.Channel.Items, 2) {
+		assert.Equal(feed.Channel.Items[0].GUID, rotated.Channel.Items[0].GUID)
+		assert.NotEqual(feed.Channel.Items[0].Enclosure.URL, rotated.Channel.Items[0].Enclosure.URL)
+	}
+
+	log := s.storage.FeedLog()
+	if assert.Len(log, 2) {
+		assert.Equal(secret, log[0].Secret)
+		assert.Equal("default", log[0].Channel)
+	}
+}
+
+func TestFeedSidecar(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-01 Third.mp3",
+		Title:     "Third",
+		Published: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		Episode:   3,
+		Duration:  time.Hour + 2*time.Minute + 3*time.Second,
+		Artwork:   "third.jpg",
+		GUID:      "third-episode",
+	}, []byte("third")))
+	s.backend.AddFile("third.jpg", []byte("artwork"))
+	assert.NoError(s.updatePodcasts())
+
+	var feed testFeed
+	res := s.get("/feed?s=" + secret)
+	assert.NoError(xml.NewDecoder(res.Body).Decode(&feed))
+	if assert.Len(feed.Channel.Items, 3) {
+		item := feed.Channel.Items[0]
+		assert.Equal("third-episode", item.GUID.Value)
+		assert.Equal("false", item.GUID.IsPermaLink)
+		assert.Equal("1:02:03", item.Duration)
+		assert.Equal(3, item.Episode)
+
+		res = s.get(strings.TrimPrefix(item.Image.HREF, testBaseURL))
+		assert.Equal(http.StatusOK, res.StatusCode)
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal("artwork", string(body))
+
+		// episodes without a sidecar use the logo as their image
+		assert.Equal(testBaseURL+"/logo", feed.Channel.Items[1].Image.HREF)
+	}
+
+	assert.Equal(http.StatusForbidden, s.get("/artwork?n=2020-03-01+Third.mp3").StatusCode)
+	assert.Equal(http.StatusNotFound, s.get("/artwork?n=2020-02-03+Second.mp3&s="+secret).StatusCode)
+}
+
+func TestFeedVideo(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-01 Video.m4v",
+		Title:     "Video",
+		Published: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+	}, []byte("video")))
+	assert.NoError(s.updatePodcasts())
+
+	var feed testFeed
+	assert.NoError(xml.NewDecoder(s.get("/feed?s=" + secret).Body).Decode(&feed))
+	if assert.Len(feed.Channel.Items, 3) {
+		assert.Equal("video/x-m4v", feed.Channel.Items[0].Enclosure.Type)
+		assert.Equal("audio/mpeg", feed.Channel.Items[1].Enclosure.Type)
+	}
+
+	res := s.get("/podcast?n=2020-03-01+Video.m4v&s=" + secret)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("video/x-m4v", res.Header.Get("Content-Type"))
+}
+
+func TestChapters(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-01 Chapters.mp3",
+		Title:     "Chapters",
+		Published: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		Chapters:  []pp.Chapter{{Start: 0, Title: "Intro"}, {Start: 90 * time.Second, Title: "Main", URL: "https://example.com"}},
+	}, []byte("chapters")))
+	assert.NoError(s.updatePodcasts())
+
+	var feed struct {
+		Items []struct {
+			Chapters struct {
+				URL  string `xml:"url,attr"`
+				Type string `xml:"type,attr"`
+			} `xml:"https://podcastindex.org/namespace/1.0 chapters"`
+		} `xml:"channel>item"`
+	}
+	assert.NoError(xml.NewDecoder(s.get("/feed?s=" + secret).Body).Decode(&feed))
+	if !assert.Len(feed.Items, 3) {
+		return
+	}
+	assert.Equal("application/json+chapters", feed.Items[0].Chapters.Type)
+	assert.Equal("", feed.Items[1].Chapters.URL, "episodes without chapters don't refer to them")
+
+	res := s.get(strings.TrimPrefix(feed.Items[0].Chapters.URL, testBaseURL))
+	assert.Equal(http.StatusOK, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.JSONEq(`{"version": "1.2.0", "chapters": [
+		{"startTime": 0, "title": "Intro"},
+		{"startTime": 90, "title": "Main", "url": "https://example.com"}
+	]}`, string(body))
+
+	// the home page lists the chapters, their starts seek the player
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(s.login(t, "alice@example.com"))
+	body, _ = ioutil.ReadAll(s.do(r).Body)
+	assert.Contains(string(body), `<a href="#" data-start="90">0:01:30</a> <a href="https://example.com">Main</a>`)
+
+	assert.Equal(http.StatusForbidden, s.get("/chapters?n=2020-03-01+Chapters.mp3").StatusCode)
+	assert.Equal(http.StatusNotFound, s.get("/chapters?n=2020-02-03+Second.mp3&s="+secret).StatusCode)
+}
+
+func TestTranscript(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-01 Transcript.mp3",
+		Title:     "Transcript",
+		Published: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		Transcripts: []pp.Transcript{
+			{Key: "2020-03-01 Transcript.mp3.srt", ContentType: "application/x-subrip"},
+			{Key: "2020-03-01 Transcript.mp3.transcript.txt", ContentType: "text/plain"},
+		},
+	}, []byte("transcript")))
+	s.backend.AddFile("2020-03-01 Transcript.mp3.srt", []byte("1\r\n00:00:01,500 --> 00:00:03,000\r\nHello\r\n"))
+	s.backend.AddFile("2020-03-01 Transcript.mp3.transcript.txt", []byte("Hello"))
+	assert.NoError(s.updatePodcasts())
+
+	var feed struct {
+		Items []struct {
+			Transcripts []struct {
+				URL  string `xml:"url,attr"`
+				Type string `xml:"type,attr"`
+				Rel  string `xml:"rel,attr"`
+			} `xml:"https://podcastindex.org/namespace/1.0 transcript"`
+		} `xml:"channel>item"`
+	}
+	assert.NoError(xml.NewDecoder(s.get("/feed?s=" + secret).Body).Decode(&feed))
+	if !assert.Len(feed.Items, 3) || !assert.Len(feed.Items[0].Transcripts, 2) {
+		return
+	}
+	srt, txt := feed.Items[0].Transcripts[0], feed.Items[0].Transcripts[1]
+	assert.Equal("application/x-subrip", srt.Type)
+	assert.Equal("captions", srt.Rel)
+	assert.Equal("text/plain", txt.Type)
+	assert.Equal("", txt.Rel)
+	assert.Empty(feed.Items[1].Transcripts)
+
+	res := s.get(strings.TrimPrefix(txt.URL, testBaseURL))
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal("Hello", string(body))
+
+	// the home page plays the captions along, SubRip is converted to WebVTT
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(s.login(t, "alice@example.com"))
+	body, _ = ioutil.ReadAll(s.do(r).Body)
+	assert.Contains(string(body), `<track kind="captions"`)
+
+	res = s.get("/transcript?n=2020-03-01+Transcript.mp3&t=vtt&s=" + secret)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("text/vtt; charset=utf-8", res.Header.Get("Content-Type"))
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Equal("WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.000\nHello\n", string(body))
+
+	assert.Equal(http.StatusForbidden, s.get("/transcript?n=2020-03-01+Transcript.mp3&t=txt").StatusCode)
+	assert.Equal(http.StatusNotFound, s.get("/transcript?n=2020-02-03+Second.mp3&t=vtt&s="+secret).StatusCode)
+}
+
+func TestScheduled(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	now := time.Now()
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-01 Expired.mp3",
+		Title:     "Expired",
+		Published: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		Expires:   now.Add(-time.Minute),
+	}, []byte("expired")))
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-02 Soon.mp3",
+		Title:     "Soon",
+		Published: now.Add(200 * time.Millisecond),
+	}, []byte("soon")))
+	s.backend.Add(pptest.NewPodcast(pp.PodcastDetails{
+		Key:       "2020-03-03 Later.mp3",
+		Title:     "Later, too",
+		Published: now.Add(time.Hour),
+	}, []byte("later")))
+	assert.NoError(s.updatePodcasts())
+
+	titles := func() []string {
+		var feed testFeed
+		assert.NoError(xml.NewDecoder(s.get("/feed?s=" + secret).Body).Decode(&feed))
+		var titles []string
+		for _, item := range feed.Channel.Items {
+			titles = append(titles, item.Title)
+		}
+		return titles
+	}
+	assert.Equal([]string{"Second", "Hello World!"}, titles())
+
+	// the episode is published on time without updating the podcasts
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal([]string{"Soon", "Second", "Hello World!"}, titles())
+
+	// the calendar of the scheduled episodes is only for admins
+	assert.Equal(http.StatusForbidden, s.get("/calendar?s="+secret).StatusCode)
+	assert.NoError(s.storage.SetRole("alice@example.com", pp.RoleAdmin))
+	res := s.get("/calendar?s=" + secret)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("text/calendar; charset=utf-8", res.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(string(body), "BEGIN:VEVENT\r\nUID:"+pp.KeyGUID("2020-03-03 Later.mp3")+"\r\n")
+	assert.Contains(string(body), "DTSTART:"+now.Add(time.Hour).UTC().Format("20060102T150405Z")+"\r\n")
+	assert.Contains(string(body), "SUMMARY:Test Podcast: Later\\, too\r\n")
+	assert.Equal(1, strings.Count(string(body), "BEGIN:VEVENT"))
+}
+
+func TestFeedAccess(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	assert.Equal(http.StatusForbidden, s.get("/feed?s=invalid").StatusCode)
+	assert.Equal(http.StatusForbidden, s.get("/feed").StatusCode)
+	assert.Equal(http.StatusNotFound, s.get("/feed?c=nope&s="+secret).StatusCode)
+
+	// restricted channels need a grant
+	assert.Equal(http.StatusForbidden, s.get("/feed?c=members&s="+secret).StatusCode)
+	assert.NoError(s.storage.GrantChannel("alice@example.com", "members"))
+	res := s.get("/feed?c=members&s=" + secret)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var feed testFeed
+	assert.NoError(xml.NewDecoder(res.Body).Decode(&feed))
+	if assert.Len(feed.Channel.Items, 1) {
+		assert.Contains(feed.Channel.Items[0].Enclosure.URL, "c=members")
+	}
+
+	// suspending takes effect immediately
+	assert.NoError(s.storage.SuspendUser("alice@example.com", "testing"))
+	assert.Equal(http.StatusForbidden, s.get("/feed?s="+secret).StatusCode)
+
+	// so does rotating the secret
+	assert.NoError(s.storage.UnsuspendUser("alice@example.com"))
+	_, err := s.storage.RotateSecret("alice@example.com", "testing")
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, s.get("/feed?s="+secret).StatusCode)
+}
+
+func TestRestrictedChannel(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+	session := s.login(t, "alice@example.com")
+
+	home := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(session)
+		body, _ := ioutil.ReadAll(s.do(r).Body)
+		return string(body)
+	}
+	membersFeed := "/feed?c=members&s=" + secret
+
+	// the restricted channel is hidden from a user without a grant
+	assert.NotContains(home(), "Members Only")
+	assert.Contains(home(), "Hello World!")
+	assert.Equal(http.StatusForbidden, s.get(membersFeed).StatusCode)
+
+	assert.NoError(s.storage.GrantChannel("alice@example.com", "members"))
+	assert.Contains(home(), "Members Only")
+	assert.Equal(http.StatusOK, s.get(membersFeed).StatusCode)
+
+	// revoking the grant hides it again
+	assert.NoError(s.storage.RevokeChannel("alice@example.com", "members"))
+	assert.NotContains(home(), "Members Only")
+	assert.Equal(http.StatusForbidden, s.get(membersFeed).StatusCode)
+}
+
+func TestPodcast(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	target := "/podcast?" + url.Values{"n": {"2020-01-27 Hello World!.mp3"}, "s": {secret}}.Encode()
+
+	res := s.get(target)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("audio/mpeg", res.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal("0123456789", string(body))
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Range", "bytes=2-5")
+	res = s.do(r)
+	assert.Equal(http.StatusPartialContent, res.StatusCode)
+	assert.Equal("bytes 2-5/10", res.Header.Get("Content-Range"))
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Equal("2345", string(body))
+
+	assert.Equal(http.StatusNotFound, s.get("/podcast?n=nope.mp3&s="+secret).StatusCode)
+	assert.Equal(http.StatusForbidden, s.get("/podcast?n=nope.mp3&s=invalid").StatusCode)
+	assert.Equal(http.StatusForbidden, s.get("/podcast?c=members&n=2020-01-01+Members+Only.mp3&s="+secret).StatusCode)
+
+	log := s.storage.PodcastLog()
+	if assert.Len(log, 3) {
+		assert.Equal("2020-01-27 Hello World!.mp3", log[0].Key)
+	}
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	// a channel that can't be updated keeps the current ones
+	broken := pptest.NewBackend(nil)
+	broken.SetError(errors.New("temporary error"))
+	assert.Error(s.reload("broken help", []*channel{
+		newChannel("default", "Broken", "", false, broken),
+	}))
+	assert.Equal("", s.getHelpText())
+	var feed testFeed
+	assert.NoError(xml.NewDecoder(s.get("/feed?s=" + secret).Body).Decode(&feed))
+	assert.Equal("Test Podcast", feed.Channel.Title)
+	assert.Len(feed.Channel.Items, 2)
+
+	renamed := newChannel("default", "Renamed", "", false, s.backend)
+	assert.NoError(s.reload("new help", []*channel{renamed}))
+
+	assert.Equal("new help", s.getHelpText())
+	assert.Equal(http.StatusNotFound, s.get("/feed?c=members&s="+secret).StatusCode)
+
+	feed = testFeed{}
+	res := s.get("/feed?s=" + secret)
+	assert.NoError(xml.NewDecoder(res.Body).Decode(&feed))
+	assert.Equal("Renamed", feed.Channel.Title)
+	assert.Len(feed.Channel.Items, 2, "the podcasts are updated before the channel is served")
+}
+
+// panicBackend panics when its podcasts are listed.
+type panicBackend struct {
+	*pptest.Backend
+}
+
+func (panicBackend) ListPodcasts() ([]pp.Podcast, error) {
+	panic("malformed file")
+}
+
+func TestUpdatePanic(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+
+	c := newChannel("broken", "Broken", "", false, panicBackend{pptest.NewBackend(nil)})
+	err := s.updateChannel(c)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "malformed file")
+	}
+	_, failures, updateErr := c.updateStatus()
+	assert.Equal(1, failures)
+	assert.Equal(err, updateErr)
+}
+
+func TestShutdown(t *testing.T) {
+	s := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.start(ctx, "127.0.0.1:0", time.Hour, time.Hour, time.Second)
+	}()
+	cancel()
+
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop")
+	}
+}
+
+func TestReady(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+
+	assert.Equal(http.StatusOK, s.get("/healthz").StatusCode)
+	assert.Equal(http.StatusOK, s.get("/readyz").StatusCode)
+
+	s.storage.SetPingError(errors.New("connection refused"))
+	assert.Equal(http.StatusServiceUnavailable, s.get("/readyz").StatusCode)
+	s.storage.SetPingError(nil)
+
+	s.backend.SetError(errors.New("access denied"))
+	assert.Error(s.updatePodcasts())
+	res := s.get("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal("the last 1 update(s) of channel \"default\" failed\n", string(body))
+
+	// the process is still alive
+	assert.Equal(http.StatusOK, s.get("/healthz").StatusCode)
+
+	s.backend.SetError(nil)
+	assert.NoError(s.updatePodcasts())
+	assert.Equal(http.StatusOK, s.get("/readyz").StatusCode)
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	s.get("/feed?s=" + secret)
+	s.get("/podcast?" + url.Values{"n": {"2020-01-27 Hello World!.mp3"}, "s": {secret}}.Encode())
+	s.backend.SetError(errors.New("access denied"))
+	assert.Error(s.updatePodcasts())
+
+	assert.Equal(http.StatusUnauthorized, s.get("/metrics").StatusCode)
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer metrics token")
+	res := s.do(r)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+
+	for _, line := range []string{
+		`pp_http_requests_total{handler="feed",code="200"} 1`,
+		`pp_http_request_duration_seconds_count{handler="podcast"} 1`,
+		`pp_episode_bytes_total{channel="default",episode="2020-01-27 Hello World!.mp3"} 10`,
+		`pp_refresh_errors_total{channel="default"} 1`,
+		`pp_refresh_consecutive_failures{channel="default"} 1`,
+		`pp_refresh_duration_seconds_count{channel="members"} 2`,
+		`pp_storage_query_duration_seconds_count{method="UserBySecret"} 2`,
+	} {
+		assert.Contains(string(body), line+"\n")
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+
+	var out bytes.Buffer
+	logger, err := pp.NewLogger(&out, pp.LevelDebug, pp.LogFormatJSON)
+	assert.NoError(err)
+	s.log = logger
+
+	r := httptest.NewRequest(http.MethodGet, "/feed?s="+secret, nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	res := s.do(r)
+	assert.Equal("req-1", res.Header.Get("X-Request-ID"))
+
+	// an invalid ID is replaced
+	r = httptest.NewRequest(http.MethodGet, "/feed?s=invalid", nil)
+	r.Header.Set("X-Request-ID", "not valid")
+	res = s.do(r)
+	assert.Len(res.Header.Get("X-Request-ID"), 16)
+
+	assert.NotContains(out.String(), secret)
+	assert.NotContains(out.String(), "s=invalid")
+
+	var requests int
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(line), &entry))
+		assert.NotEmpty(entry["request_id"], line)
+		if entry["msg"] == "request" {
+			requests++
+			assert.Equal("/feed", entry["path"])
+		}
+	}
+	assert.Equal(2, requests)
+}
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.1")
+
+	// without a proxy anyone could set the header
+	assert.Equal("192.0.2.1", s.clientIP(r))
+
+	proxied := newServer(testBaseURL, "", nil, nil, nil, false, nil, []byte("cookie key"), time.Hour, time.Hour, "", true, pp.Logger{})
+	assert.Equal("203.0.113.1", proxied.clientIP(r))
+}
+
+func TestHTTPToHTTPS(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/feed?s=secret", nil)
+	r.Header.Set("X-Forwarded-Proto", "http")
+	res := s.do(r)
+	assert.Equal(http.StatusTemporaryRedirect, res.StatusCode)
+	assert.Equal(testBaseURL+"/feed?s=secret", res.Header.Get("Location"))
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+
+	res := s.get("/")
+	assert.Equal(http.StatusOK, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(string(body), "login")
+	assert.NotContains(string(body), "/feed?")
+
+	// starting the login redirects to the provider
+	res = s.get(loginURL("/?n=2020-02-03+Second.mp3"))
+	assert.Equal(http.StatusTemporaryRedirect, res.StatusCode)
+	authState := responseCookie(res, authStateCookie)
+	if !assert.NotNil(authState) {
+		return
+	}
+	assert.True(authState.HttpOnly)
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	assert.NoError(err)
+	state := location.Query().Get("state")
+	code := s.auth.Login(pp.Identity{UserID: "alice@example.com"}, location.Query().Get("code_challenge"))
+
+	// the provider redirects back without the state cookie (or with another state)
+	res = s.get("/auth?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth?"+url.Values{"code": {code}, "state": {"other"}}.Encode(), nil)
+	r.AddCookie(authState)
+	assert.Equal(http.StatusBadRequest, s.do(r).StatusCode)
+
+	r = httptest.NewRequest(http.MethodGet, "/auth?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	r.AddCookie(authState)
+	res = s.do(r)
+	assert.Equal(http.StatusTemporaryRedirect, res.StatusCode)
+	assert.Equal("/?n=2020-02-03+Second.mp3", res.Header.Get("Location"))
+	session := responseCookie(res, sessionCookie)
+	if !assert.NotNil(session) {
+		return
+	}
+	assert.True(session.HttpOnly)
+
+	secret, err := s.storage.UserSecret("alice@example.com")
+	assert.NoError(err)
+	assert.NotContains(session.Value, secret)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(session)
+	res = s.do(r)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(string(body), "s="+secret)
+	assert.Contains(string(body), "logout")
+
+	// logging out is a form, a link of another site can't log the user out
+	r = httptest.NewRequest(http.MethodGet, "/?action=logout", nil)
+	r.AddCookie(session)
+	assert.Equal(http.StatusMethodNotAllowed, s.do(r).StatusCode)
+	assert.Equal(http.StatusForbidden, s.post(session, "/?action=logout", nil).StatusCode)
+
+	// logging out ends the session on the server too
+	token := s.pageCSRFToken(t, session, "/")
+	res = s.post(session, "/?action=logout", url.Values{"csrf": {token}})
+	assert.Equal(http.StatusSeeOther, res.StatusCode)
+	if cleared := responseCookie(res, sessionCookie); assert.NotNil(cleared) {
+		assert.True(cleared.MaxAge < 0)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(session)
+	res = s.do(r)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.False(strings.Contains(string(body), "s="+secret))
+}
+
+func TestAdmin(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	s.createUser(t, "alice@example.com")
+	bobSecret := s.createUser(t, "bob@example.com")
+	assert.NoError(s.storage.SetRole("alice@example.com", pp.RoleAdmin))
+	alice := s.login(t, "alice@example.com")
+	bob := s.login(t, "bob@example.com")
+
+	get := func(session *http.Cookie) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		r.AddCookie(session)
+		return s.do(r)
+	}
+
+	// only admins have access
+	res := s.get("/admin")
+	assert.Equal(http.StatusTemporaryRedirect, res.StatusCode)
+	assert.Equal(http.StatusForbidden, get(bob).StatusCode)
+
+	assert.Equal(http.StatusOK, get(alice).StatusCode)
+	token := s.pageCSRFToken(t, alice, "/admin")
+
+	post := func(session *http.Cookie, action string, form url.Values) *http.Response {
+		return s.post(session, "/admin?action="+action, form)
+	}
+	action := func(action string, form url.Values) {
+		form.Set("csrf", token)
+		res := post(alice, action, form)
+		assert.Equal(http.StatusSeeOther, res.StatusCode, action)
+		assert.NotContains(res.Header.Get("Location"), "Failed", action)
+	}
+	bobStatus := func() pp.UserStatus {
+		users, err := s.storage.Users()
+		assert.NoError(err)
+		for _, u := range users {
+			if u.ID == "bob@example.com" {
+				return u
+			}
+		}
+		t.Fatal("bob@example.com not found")
+		return pp.UserStatus{}
+	}
+
+	// the actions need the token of the session
+	suspend := url.Values{"user": {"bob@example.com"}, "reason": {"leaked"}}
+	assert.Equal(http.StatusForbidden, post(alice, "suspend", suspend).StatusCode)
+	suspend.Set("csrf", "forged")
+	assert.Equal(http.StatusForbidden, post(alice, "suspend", suspend).StatusCode)
+	otherToken, err := s.csrfToken("other session")
+	assert.NoError(err)
+	suspend.Set("csrf", otherToken)
+	assert.Equal(http.StatusForbidden, post(alice, "suspend", suspend).StatusCode)
+	suspend.Set("csrf", token)
+	assert.Equal(http.StatusForbidden, post(bob, "suspend", suspend).StatusCode)
+	assert.False(bobStatus().Suspended)
+
+	action("suspend", suspend)
+	assert.True(bobStatus().Suspended)
+	assert.Equal("leaked (by alice@example.com)", bobStatus().SuspendedReason)
+	action("unsuspend", url.Values{"user": {"bob@example.com"}})
+	assert.False(bobStatus().Suspended)
+
+	action("rotate", url.Values{"user": {"bob@example.com"}, "reason": {"lost phone"}})
+	rotated, err := s.storage.UserSecret("bob@example.com")
+	assert.NoError(err)
+	assert.NotEqual(bobSecret, rotated)
+
+	action("revoke", url.Values{"secret": {testBaseURL + "/feed?s=" + rotated}, "reason": {"leaked"}})
+	revoked, err := s.storage.UserSecret("bob@example.com")
+	assert.NoError(err)
+	assert.NotEqual(rotated, revoked)
+
+	action("end-sessions", url.Values{"user": {"bob@example.com"}})
+	sessions, err := s.storage.Sessions("bob@example.com")
+	assert.NoError(err)
+	assert.Empty(sessions)
+
+	action("role", url.Values{"user": {"bob@example.com"}, "role": {pp.RoleAdmin}})
+	assert.Equal(pp.RoleAdmin, bobStatus().Role)
+	action("role", url.Values{"user": {"bob@example.com"}, "role": {pp.RoleUser}})
+	assert.Equal(pp.RoleUser, bobStatus().Role)
+
+	action("grant-channel", url.Values{"user": {"bob@example.com"}, "channel": {"members"}})
+	channels, err := s.storage.UserChannels("bob@example.com")
+	assert.NoError(err)
+	assert.Equal([]string{"members"}, channels)
+	action("revoke-channel", url.Values{"user": {"bob@example.com"}, "channel": {"members"}})
+	channels, err = s.storage.UserChannels("bob@example.com")
+	assert.NoError(err)
+	assert.Empty(channels)
+
+	action("add-rule", url.Values{"rule": {"@Example.com"}})
+	rules, err := s.storage.AccessRules()
+	assert.NoError(err)
+	assert.Equal([]string{"@example.com"}, rules)
+	action("remove-rule", url.Values{"rule": {"@example.com"}})
+	rules, err = s.storage.AccessRules()
+	assert.NoError(err)
+	assert.Empty(rules)
+}
+
+func TestRotateSecret(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	secret := s.createUser(t, "alice@example.com")
+	session := s.login(t, "alice@example.com")
+
+	// the form of another site doesn't have the token
+	assert.Equal(http.StatusForbidden, s.post(session, "/?action=rotate", nil).StatusCode)
+	current, err := s.storage.UserSecret("alice@example.com")
+	assert.NoError(err)
+	assert.Equal(secret, current)
+
+	token := s.pageCSRFToken(t, session, "/")
+	res := s.post(session, "/?action=rotate", url.Values{"csrf": {token}, "reason": {"leaked"}})
+	assert.Equal(http.StatusSeeOther, res.StatusCode)
+	current, err = s.storage.UserSecret("alice@example.com")
+	assert.NoError(err)
+	assert.NotEqual(secret, current)
+
+	history, err := s.storage.SecretHistory("alice@example.com")
+	assert.NoError(err)
+	if assert.Len(history, 1) {
+		assert.Equal("leaked", history[0].Reason)
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestServer(t)
+	s.createUser(t, "alice@example.com")
+	session := s.login(t, "alice@example.com")
+	other := s.login(t, "alice@example.com")
+
+	sessions, err := s.storage.Sessions("alice@example.com")
+	assert.NoError(err)
+	assert.Len(sessions, 2)
+	otherID := pp.SessionID(other.Value)
+
+	// the form of another site doesn't have the token
+	form := url.Values{"session": {otherID}}
+	assert.Equal(http.StatusForbidden, s.post(session, "/?action=end-session", form).StatusCode)
+	sessions, err = s.storage.Sessions("alice@example.com")
+	assert.NoError(err)
+	assert.Len(sessions, 2)
+
+	form.Set("csrf", s.pageCSRFToken(t, session, "/"))
+	assert.Equal(http.StatusSeeOther, s.post(session, "/?action=end-session", form).StatusCode)
+	sessions, err = s.storage.Sessions("alice@example.com")
+	assert.NoError(err)
+	if assert.Len(sessions, 1) {
+		assert.NotEqual(otherID, sessions[0].ID)
+	}
+
+	form = url.Values{"all": {"1"}, "csrf": {form.Get("csrf")}}
+	assert.Equal(http.StatusSeeOther, s.post(session, "/?action=end-session", form).StatusCode)
+	sessions, err = s.storage.Sessions("alice@example.com")
+	assert.NoError(err)
+	assert.Empty(sessions)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// metricsStorage records the duration and the errors of every call to the
+// storage it wraps.
+type metricsStorage struct {
+	pp.Storage
+	metrics *metrics
+}
+
+// observe starts timing a call to method, the returned function records it
+// and has to be deferred with a pointer to the error returned by the call.
+func (s metricsStorage) observe(method string) func(*error) {
+	start := time.Now()
+	return func(err *error) {
+		s.metrics.storageDuration.observe(time.Since(start), method)
+		if *err != nil {
+			s.metrics.storageErrors.add(1, method)
+		}
+	}
+}
+
+// Ping checks the storage if it's a pp.Pinger, other storages are always reachable.
+func (s metricsStorage) Ping() (err error) {
+	pinger, ok := s.Storage.(pp.Pinger)
+	if !ok {
+		return nil
+	}
+
+	defer s.observe("Ping")(&err)
+	return pinger.Ping()
+}
+
+func (s metricsStorage) Init() (err error) {
+	defer s.observe("Init")(&err)
+	return s.Storage.Init()
+}
+
+func (s metricsStorage) CreateUser(userID, hostedDomain string) (secret string, err error) {
+	defer s.observe("CreateUser")(&err)
+	return s.Storage.CreateUser(userID, hostedDomain)
+}
+
+func (s metricsStorage) UserBySecret(secret string) (user pp.User, ok bool, err error) {
+	defer s.observe("UserBySecret")(&err)
+	return s.Storage.UserBySecret(secret)
+}
+
+func (s metricsStorage) UserSecret(userID string) (secret string, err error) {
+	defer s.observe("UserSecret")(&err)
+	return s.Storage.UserSecret(userID)
+}
+
+func (s metricsStorage) CreateSession(userID, userAgent, clientIP string, expiresAt time.Time) (cookie string, err error) {
+	defer s.observe("CreateSession")(&err)
+	return s.Storage.CreateSession(userID, userAgent, clientIP, expiresAt)
+}
+
+func (s metricsStorage) SessionUser(cookie string, idleTimeout time.Duration) (user pp.User, ok bool, err error) {
+	defer s.observe("SessionUser")(&err)
+	return s.Storage.SessionUser(cookie, idleTimeout)
+}
+
+func (s metricsStorage) Sessions(userID string) (out []pp.Session, err error) {
+	defer s.observe("Sessions")(&err)
+	return s.Storage.Sessions(userID)
+}
+
+func (s metricsStorage) DeleteSession(userID, sessionID string) (err error) {
+	defer s.observe("DeleteSession")(&err)
+	return s.Storage.DeleteSession(userID, sessionID)
+}
+
+func (s metricsStorage) DeleteSessionByCookie(cookie string) (err error) {
+	defer s.observe("DeleteSessionByCookie")(&err)
+	return s.Storage.DeleteSessionByCookie(cookie)
+}
+
+func (s metricsStorage) DeleteUserSessions(userID string) (err error) {
+	defer s.observe("DeleteUserSessions")(&err)
+	return s.Storage.DeleteUserSessions(userID)
+}
+
+func (s metricsStorage) SetRole(userID, role string) (err error) {
+	defer s.observe("SetRole")(&err)
+	return s.Storage.SetRole(userID, role)
+}
+
+func (s metricsStorage) SuspendUser(userID, reason string) (err error) {
+	defer s.observe("SuspendUser")(&err)
+	return s.Storage.SuspendUser(userID, reason)
+}
+
+func (s metricsStorage) UnsuspendUser(userID string) (err error) {
+	defer s.observe("UnsuspendUser")(&err)
+	return s.Storage.UnsuspendUser(userID)
+}
+
+func (s metricsStorage) Users() (out []pp.UserStatus, err error) {
+	defer s.observe("Users")(&err)
+	return s.Storage.Users()
+}
+
+func (s metricsStorage) EpisodeStats() (out []pp.EpisodeStats, err error) {
+	defer s.observe("EpisodeStats")(&err)
+	return s.Storage.EpisodeStats()
+}
+
+func (s metricsStorage) FeedClients() (out []pp.FeedClient, err error) {
+	defer s.observe("FeedClients")(&err)
+	return s.Storage.FeedClients()
+}
+
+func (s metricsStorage) RotateSecret(userID, reason string) (secret string, err error) {
+	defer s.observe("RotateSecret")(&err)
+	return s.Storage.RotateSecret(userID, reason)
+}
+
+func (s metricsStorage) RevokeSecret(secret, reason string) (err error) {
+	defer s.observe("RevokeSecret")(&err)
+	return s.Storage.RevokeSecret(secret, reason)
+}
+
+func (s metricsStorage) SecretHistory(userID string) (out []pp.SecretEvent, err error) {
+	defer s.observe("SecretHistory")(&err)
+	return s.Storage.SecretHistory(userID)
+}
+
+func (s metricsStorage) AddAccessRule(rule string) (err error) {
+	defer s.observe("AddAccessRule")(&err)
+	return s.Storage.AddAccessRule(rule)
+}
+
+func (s metricsStorage) RemoveAccessRule(rule string) (err error) {
+	defer s.observe("RemoveAccessRule")(&err)
+	return s.Storage.RemoveAccessRule(rule)
+}
+
+func (s metricsStorage) AccessRules() (out []string, err error) {
+	defer s.observe("AccessRules")(&err)
+	return s.Storage.AccessRules()
+}
+
+func (s metricsStorage) UserAllowed(userID, hostedDomain string) (ok bool, err error) {
+	defer s.observe("UserAllowed")(&err)
+	return s.Storage.UserAllowed(userID, hostedDomain)
+}
+
+func (s metricsStorage) GrantChannel(userID, channel string) (err error) {
+	defer s.observe("GrantChannel")(&err)
+	return s.Storage.GrantChannel(userID, channel)
+}
+
+func (s metricsStorage) RevokeChannel(userID, channel string) (err error) {
+	defer s.observe("RevokeChannel")(&err)
+	return s.Storage.RevokeChannel(userID, channel)
+}
+
+func (s metricsStorage) UserChannels(userID string) (out []string, err error) {
+	defer s.observe("UserChannels")(&err)
+	return s.Storage.UserChannels(userID)
+}
+
+func (s metricsStorage) SecretActivity(since time.Time) (out []pp.SecretActivity, err error) {
+	defer s.observe("SecretActivity")(&err)
+	return s.Storage.SecretActivity(since)
+}
+
+func (s metricsStorage) LogFeed(secret, channel, referer, userAgent, clientIP string) (err error) {
+	defer s.observe("LogFeed")(&err)
+	return s.Storage.LogFeed(secret, channel, referer, userAgent, clientIP)
+}
+
+func (s metricsStorage) LogPodcast(secret, channel, key, referer, userAgent, clientIP string) (err error) {
+	defer s.observe("LogPodcast")(&err)
+	return s.Storage.LogPodcast(secret, channel, key, referer, userAgent, clientIP)
+}
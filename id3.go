@@ -0,0 +1,668 @@
+package pp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// EmbeddedArtwork is an image embedded in the episode file (e.g. an ID3 APIC
+// frame), Offset and Size are the location of the image in the file.
+type EmbeddedArtwork struct {
+	Offset      int64
+	Size        int64
+	ContentType string
+}
+
+// rangeReader reads length bytes at offset of a file, the range is always
+// inside of the file. It's used to only fetch the parts of a file that are
+// needed, which matters with S3.
+type rangeReader func(offset, length int64) ([]byte, error)
+
+// id3Tags are the details read from the ID3 tags and the MPEG frames of a MP3
+// file, the zero values are used for the details that are missing.
+type id3Tags struct {
+	Title    string
+	Artist   string
+	Comment  string
+	Track    int
+	Duration time.Duration
+	Artwork  *EmbeddedArtwork
+	Chapters []Chapter
+}
+
+const (
+	// id3HeadSize is the number of bytes read from the start of the file,
+	// it usually covers the whole ID3v2 tag and the first MPEG frame
+	id3HeadSize = 64 * 1024
+	// id3MaxTagSize is the size of the largest ID3v2 tag that is read
+	id3MaxTagSize = 32 * 1024 * 1024
+	// mpegSyncSearch is how far after the ID3v2 tag the first MPEG frame is searched
+	mpegSyncSearch = 16 * 1024
+)
+
+// readID3 reads the ID3v2 and ID3v1 tags of the MP3 file and scans its MPEG
+// frames for the duration. Missing tags aren't an error, only failing to read
+// the file is.
+func readID3(read rangeReader, size int64) (id3Tags, error) {
+	var tags id3Tags
+	if size == 0 {
+		return tags, nil
+	}
+
+	head, err := read(0, min64(size, id3HeadSize))
+	if err != nil {
+		return tags, err
+	}
+
+	// ID3v1 is read first so that the values of ID3v2 override it
+	audioEnd := size
+	if size >= 128 {
+		v1, err := read(size-128, 128)
+		if err != nil {
+			return tags, err
+		}
+		if parseID3v1(v1, &tags) {
+			audioEnd -= 128
+		}
+	}
+
+	var audioStart int64
+	if len(head) >= 10 && string(head[:3]) == "ID3" {
+		tagSize := int64(syncsafe(head[6:10]))
+		audioStart = 10 + tagSize
+		if head[5]&0x10 != 0 {
+			// ID3v2.4 footer
+			audioStart += 10
+		}
+
+		tag := head
+		if 10+tagSize > int64(len(head)) {
+			if 10+tagSize > min64(size, id3MaxTagSize) {
+				return tags, fmt.Errorf("invalid ID3v2 tag: size %v is larger than the file or %v", tagSize, id3MaxTagSize)
+			}
+			tag, err = read(0, 10+tagSize)
+			if err != nil {
+				return tags, err
+			}
+		}
+		parseID3v2(tag[:10+tagSize], &tags)
+	}
+
+	if audioStart < audioEnd {
+		var audio []byte
+		if audioStart+mpegSyncSearch <= int64(len(head)) || int64(len(head)) == size {
+			audio = head[audioStart:min64(int64(len(head)), audioEnd)]
+		} else {
+			audio, err = read(audioStart, min64(audioEnd-audioStart, mpegSyncSearch))
+			if err != nil {
+				return tags, err
+			}
+		}
+		if d, ok := mpegDuration(audio, audioEnd-audioStart); ok {
+			tags.Duration = d
+		}
+	}
+
+	return tags, nil
+}
+
+// apply returns the details with the values found in the tags, the title and
+// the description are only replaced if the tags have them.
+func (t id3Tags) apply(details PodcastDetails) PodcastDetails {
+	if t.Title != "" {
+		details.Title = t.Title
+	}
+	if t.Comment != "" {
+		details.Description = t.Comment
+	}
+	details.Artist = t.Artist
+	details.Track = t.Track
+	details.Duration = t.Duration
+	details.EmbeddedArtwork = t.Artwork
+	details.Chapters = t.Chapters
+	return details
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// syncsafe decodes a syncsafe integer (7 bits per byte).
+func syncsafe(b []byte) uint32 {
+	var n uint32
+	for _, c := range b {
+		n = n<<7 | uint32(c&0x7f)
+	}
+	return n
+}
+
+// unsynchronise reverts the unsynchronisation of ID3v2, which inserts a zero
+// after every 0xff.
+func unsynchronise(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// parseID3v1 parses the ID3v1 tag (the last 128 bytes of the file), it returns
+// false if b isn't a tag.
+func parseID3v1(b []byte, tags *id3Tags) bool {
+	if len(b) != 128 || string(b[:3]) != "TAG" {
+		return false
+	}
+
+	field := func(b []byte) string {
+		return strings.TrimRight(decodeText(0, b), " \x00")
+	}
+
+	tags.Title = field(b[3:33])
+	tags.Artist = field(b[33:63])
+	comment := b[97:127]
+	// ID3v1.1 has the track number in the last byte of the comment
+	if b[125] == 0 && b[126] != 0 {
+		comment = b[97:125]
+		tags.Track = int(b[126])
+	}
+	tags.Comment = field(comment)
+
+	return true
+}
+
+// id3Frame is a single frame of an ID3v2 tag, offset is the offset of the data
+// in the file or -1 if the data isn't stored as is (it's unsynchronised).
+type id3Frame struct {
+	id     string
+	data   []byte
+	offset int64
+}
+
+// id3Frames returns the frames of the ID3v2 tag, the frames that can't be
+// read (e.g. compressed ones) are skipped.
+func id3Frames(tag []byte) []id3Frame {
+	version, flags := tag[3], tag[5]
+	body := tag[10:]
+	// bodyOffset is the offset of body in the file, -1 if it was unsynchronised
+	var bodyOffset int64 = 10
+
+	if version < 2 || version > 4 {
+		return nil
+	}
+	if version < 4 && flags&0x80 != 0 {
+		body = unsynchronise(body)
+		bodyOffset = -1
+	}
+	if flags&0x40 != 0 {
+		// ID3v2.2 uses the flag for compression, which isn't supported
+		if version == 2 || len(body) < 4 {
+			return nil
+		}
+		var extended int
+		if version == 3 {
+			extended = 4 + int(binary.BigEndian.Uint32(body))
+		} else {
+			extended = int(syncsafe(body[:4]))
+		}
+		if extended > len(body) {
+			return nil
+		}
+		body = body[extended:]
+		if bodyOffset >= 0 {
+			bodyOffset += int64(extended)
+		}
+	}
+
+	return id3FrameList(version, body, bodyOffset)
+}
+
+// id3FrameList returns the frames in body, which is either the body of a tag
+// or the sub-frames of a frame (e.g. CHAP). bodyOffset is the offset of body
+// in the file, -1 if it isn't stored as is.
+func id3FrameList(version byte, body []byte, bodyOffset int64) []id3Frame {
+	headerSize := 10
+	if version == 2 {
+		headerSize = 6
+	}
+
+	var frames []id3Frame
+	for pos := 0; pos+headerSize <= len(body); {
+		header := body[pos : pos+headerSize]
+		if header[0] == 0 {
+			// padding
+			break
+		}
+
+		var (
+			id         string
+			size       int
+			frameFlags byte
+		)
+		switch version {
+		case 2:
+			id = string(header[:3])
+			size = int(header[3])<<16 | int(header[4])<<8 | int(header[5])
+		case 3:
+			id = string(header[:4])
+			size = int(binary.BigEndian.Uint32(header[4:8]))
+			frameFlags = header[9]
+		case 4:
+			id = string(header[:4])
+			size = int(syncsafe(header[4:8]))
+			frameFlags = header[9]
+		}
+
+		start := pos + headerSize
+		if size < 0 || start+size > len(body) {
+			break
+		}
+		pos = start + size
+
+		data := body[start : start+size]
+		offset := bodyOffset + int64(start)
+		if bodyOffset < 0 {
+			offset = -1
+		}
+
+		switch version {
+		case 3:
+			if frameFlags&0xc0 != 0 {
+				// compressed or encrypted
+				continue
+			}
+			if frameFlags&0x20 != 0 && len(data) > 0 {
+				data, offset = data[1:], offset+1
+			}
+		case 4:
+			if frameFlags&0x0c != 0 {
+				// compressed or encrypted
+				continue
+			}
+			skip := 0
+			if frameFlags&0x40 != 0 {
+				skip++
+			}
+			if frameFlags&0x01 != 0 {
+				skip += 4
+			}
+			if skip > len(data) {
+				continue
+			}
+			data, offset = data[skip:], offset+int64(skip)
+			if frameFlags&0x02 != 0 {
+				data, offset = unsynchronise(data), -1
+			}
+		}
+		if offset < 0 || bodyOffset < 0 {
+			offset = -1
+		}
+
+		frames = append(frames, id3Frame{id, data, offset})
+	}
+
+	return frames
+}
+
+// parseID3v2 parses the ID3v2 tag (the header included) into tags.
+func parseID3v2(tag []byte, tags *id3Tags) {
+	var (
+		// comment is the comment without a description, fallback the first
+		// one with a description
+		comment, fallback string
+		length            time.Duration
+		artworkType       = -1
+		chapters          = make(map[string]Chapter)
+		tocs              []id3TOC
+	)
+
+	for _, f := range id3Frames(tag) {
+		switch f.id {
+		case "CHAP":
+			if id, c, err := parseID3Chapter(tag[3], f.data); err == nil {
+				chapters[id] = c
+			}
+
+		case "CTOC":
+			if _, toc, err := parseID3TOC(f.data); err == nil {
+				tocs = append(tocs, toc)
+			}
+
+		case "TIT2", "TT2":
+			if v := id3Text(f.data); v != "" {
+				tags.Title = v
+			}
+
+		case "TPE1", "TP1":
+			if v := id3Text(f.data); v != "" {
+				tags.Artist = v
+			}
+
+		case "TRCK", "TRK":
+			// the track can be followed by the number of tracks, e.g. 3/10
+			track := strings.SplitN(id3Text(f.data), "/", 2)[0]
+			if n, err := strconv.Atoi(strings.TrimSpace(track)); err == nil && n > 0 {
+				tags.Track = n
+			}
+
+		case "TLEN", "TLE":
+			if ms, err := strconv.Atoi(id3Text(f.data)); err == nil && ms > 0 {
+				length = time.Duration(ms) * time.Millisecond
+			}
+
+		case "COMM", "COM":
+			// the comments with a description are usually added by
+			// applications (e.g. iTunNORM), they are only used if there's
+			// no other comment
+			desc, text, err := parseID3Comment(f.data)
+			switch {
+			case err != nil || text == "":
+			case desc == "" && comment == "":
+				comment = text
+			case !strings.HasPrefix(desc, "iTun") && fallback == "":
+				fallback = text
+			}
+
+		case "APIC", "PIC":
+			pictureType, contentType, data, err := parseID3Picture(f.id, f.data)
+			if err != nil || f.offset < 0 || len(data) == 0 {
+				continue
+			}
+			// the front cover (3) is preferred over the other pictures
+			if artworkType == -1 || (pictureType == 3 && artworkType != 3) {
+				artworkType = pictureType
+				tags.Artwork = &EmbeddedArtwork{
+					Offset:      f.offset + int64(len(f.data)-len(data)),
+					Size:        int64(len(data)),
+					ContentType: contentType,
+				}
+			}
+		}
+	}
+
+	if comment == "" {
+		comment = fallback
+	}
+	if comment != "" {
+		tags.Comment = comment
+	}
+	if length > 0 {
+		tags.Duration = length
+	}
+	tags.Chapters = id3Chapters(chapters, tocs)
+}
+
+// decodeText decodes a string in one of the ID3v2 text encodings.
+func decodeText(encoding byte, b []byte) string {
+	switch encoding {
+	case 0:
+		// ISO-8859-1, whose code points are the same as in Unicode
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 && encoding == 1 {
+			switch {
+			case b[0] == 0xff && b[1] == 0xfe:
+				b = b[2:]
+			case b[0] == 0xfe && b[1] == 0xff:
+				b, bigEndian = b[2:], true
+			}
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+		}
+		return string(utf16.Decode(units))
+	}
+
+	return string(b)
+}
+
+// splitText splits b at the first terminator of the text encoding, rest is
+// nil if there's no terminator.
+func splitText(encoding byte, b []byte) (text, rest []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+
+	i := bytes.IndexByte(b, 0)
+	if i == -1 {
+		return b, nil
+	}
+	return b[:i], b[i+1:]
+}
+
+// id3Text decodes a text frame, only the first value is returned if the
+// frame has several.
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	text, _ := splitText(data[0], data[1:])
+	return strings.TrimSpace(decodeText(data[0], text))
+}
+
+var errShortFrame = errors.New("the frame is too short")
+
+// parseID3Comment parses a COMM (or COM) frame.
+func parseID3Comment(data []byte) (string, string, error) {
+	// the encoding and the language
+	if len(data) < 4 {
+		return "", "", errShortFrame
+	}
+	encoding := data[0]
+	desc, text := splitText(encoding, data[4:])
+	return decodeText(encoding, desc), strings.TrimSpace(decodeText(encoding, bytes.TrimRight(text, "\x00"))), nil
+}
+
+// parseID3Picture parses an APIC (or PIC) frame, data is the image.
+func parseID3Picture(id string, frame []byte) (pictureType int, contentType string, data []byte, err error) {
+	if len(frame) < 2 {
+		return 0, "", nil, errShortFrame
+	}
+	encoding, rest := frame[0], frame[1:]
+
+	if id == "PIC" {
+		// ID3v2.2 has a three letter format instead of a MIME type
+		if len(rest) < 4 {
+			return 0, "", nil, errShortFrame
+		}
+		switch strings.ToUpper(string(rest[:3])) {
+		case "PNG":
+			contentType = "image/png"
+		default:
+			contentType = "image/jpeg"
+		}
+		rest = rest[3:]
+	} else {
+		var mime []byte
+		mime, rest = splitText(0, rest)
+		if rest == nil || len(rest) < 1 {
+			return 0, "", nil, errShortFrame
+		}
+		contentType = strings.ToLower(string(mime))
+		switch contentType {
+		case "", "image/jpg":
+			contentType = "image/jpeg"
+		case "png":
+			contentType = "image/png"
+		case "jpg", "jpeg":
+			contentType = "image/jpeg"
+		}
+	}
+
+	pictureType = int(rest[0])
+	_, data = splitText(encoding, rest[1:])
+	if data == nil {
+		return 0, "", nil, errShortFrame
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return 0, "", nil, fmt.Errorf("invalid picture MIME type %q", contentType)
+	}
+
+	return pictureType, contentType, data, nil
+}
+
+// mpegBitrates are the bitrates (kbit/s) by the version (MPEG-1 or MPEG-2 and
+// 2.5), the layer and the bitrate index.
+var mpegBitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// mpegSampleRates are the sample rates by the version (MPEG-1, 2 and 2.5).
+var mpegSampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+// mpegFrame is the header of a MPEG audio frame.
+type mpegFrame struct {
+	// version is 0 for MPEG-1, 1 for MPEG-2 and 2 for MPEG-2.5
+	version    int
+	layer      int
+	bitrate    int
+	sampleRate int
+	mono       bool
+	length     int
+}
+
+// samples returns the number of samples in the frame.
+func (f mpegFrame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version != 0:
+		return 576
+	}
+	return 1152
+}
+
+// parseMPEGFrame parses the header of a MPEG audio frame, ok is false if b
+// doesn't start with a valid header.
+func parseMPEGFrame(b []byte) (f mpegFrame, ok bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return f, false
+	}
+
+	switch (b[1] >> 3) & 0x03 {
+	case 0:
+		f.version = 2
+	case 2:
+		f.version = 1
+	case 3:
+		f.version = 0
+	default:
+		return f, false
+	}
+
+	f.layer = 4 - int((b[1]>>1)&0x03)
+	bitrateIndex := int(b[2] >> 4)
+	sampleRateIndex := int((b[2] >> 2) & 0x03)
+	if f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return f, false
+	}
+
+	table := f.version
+	if table > 1 {
+		table = 1
+	}
+	f.bitrate = mpegBitrates[table][f.layer-1][bitrateIndex] * 1000
+	f.sampleRate = mpegSampleRates[f.version][sampleRateIndex]
+	f.mono = b[3]>>6 == 3
+
+	padding := int((b[2] >> 1) & 0x01)
+	if f.layer == 1 {
+		f.length = (12*f.bitrate/f.sampleRate + padding) * 4
+	} else {
+		f.length = f.samples()/8*f.bitrate/f.sampleRate + padding
+	}
+
+	return f, true
+}
+
+// mpegDuration returns the duration of the MPEG audio that starts with b and
+// is size bytes long. The number of frames is read from the Xing (or Info) and
+// VBRI headers of VBR files, without them the file is assumed to be CBR.
+func mpegDuration(b []byte, size int64) (time.Duration, bool) {
+	for i := 0; i+4 <= len(b); i++ {
+		f, ok := parseMPEGFrame(b[i:])
+		if !ok {
+			continue
+		}
+		// a false sync is unlikely to be followed by another frame
+		if next := i + f.length; next+4 <= len(b) {
+			if _, ok := parseMPEGFrame(b[next:]); !ok {
+				continue
+			}
+		}
+
+		frame := b[i:]
+		if frames, ok := mpegFrameCount(f, frame); ok {
+			seconds := float64(frames) * float64(f.samples()) / float64(f.sampleRate)
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+
+		audio := size - int64(i)
+		return time.Duration(float64(audio*8) / float64(f.bitrate) * float64(time.Second)), true
+	}
+
+	return 0, false
+}
+
+// mpegFrameCount returns the number of frames from the Xing (or Info) or the
+// VBRI header in the first frame.
+func mpegFrameCount(f mpegFrame, frame []byte) (uint32, bool) {
+	// the Xing header is after the side information, whose size depends on
+	// the version and the channels
+	sideInfo := 32
+	switch {
+	case f.version == 0 && f.mono:
+		sideInfo = 17
+	case f.version != 0 && !f.mono:
+		sideInfo = 17
+	case f.version != 0 && f.mono:
+		sideInfo = 9
+	}
+
+	if xing := 4 + sideInfo; xing+12 <= len(frame) {
+		tag := string(frame[xing : xing+4])
+		flags := binary.BigEndian.Uint32(frame[xing+4:])
+		if (tag == "Xing" || tag == "Info") && flags&0x01 != 0 {
+			return binary.BigEndian.Uint32(frame[xing+8:]), true
+		}
+	}
+
+	if vbri := 4 + 32; vbri+18 <= len(frame) && string(frame[vbri:vbri+4]) == "VBRI" {
+		return binary.BigEndian.Uint32(frame[vbri+14:]), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,170 @@
+package pp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+// id3v23Frame encodes a frame of an ID3v2.3 tag.
+func id3v23Frame(id string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(id)
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.Write([]byte{0, 0})
+	b.Write(data)
+	return b.Bytes()
+}
+
+// id3v23Tag encodes an ID3v2.3 tag with the frames.
+func id3v23Tag(frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	// padding
+	body = append(body, make([]byte, 16)...)
+
+	size := len(body)
+	header := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(header, body...)
+}
+
+// mpegFrames returns n MPEG-1 Layer III frames of 128 kbit/s at 44.1 kHz, the
+// first one has a Xing header with the number of frames if xingFrames isn't zero.
+func mpegFrames(n int, xingFrames uint32) []byte {
+	const length = 417
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		frame := make([]byte, length)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		if i == 0 && xingFrames != 0 {
+			copy(frame[36:], "Xing")
+			binary.BigEndian.PutUint32(frame[40:], 1)
+			binary.BigEndian.PutUint32(frame[44:], xingFrames)
+		}
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+func TestBackendFSID3(t *testing.T) {
+	assert := assert.New(t)
+
+	artwork := []byte("\x89PNG not really")
+	tag := id3v23Tag(
+		// UTF-16 with BOM
+		id3v23Frame("TIT2", []byte("\x01\xff\xfeH\x00\xe9\x00l\x00l\x00o\x00")),
+		id3v23Frame("TPE1", []byte("\x00The Host")),
+		id3v23Frame("TRCK", []byte("\x007/12")),
+		id3v23Frame("COMM", []byte("\x00engiTunNORM\x00 000001")),
+		id3v23Frame("COMM", []byte("\x00eng\x00The comment.")),
+		id3v23Frame("APIC", append([]byte("\x00image/png\x00\x03cover\x00"), artwork...)),
+	)
+
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "ID3v1 title")
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 VBR.mp3":        string(tag) + string(mpegFrames(10, 1000)) + string(v1),
+		"2020-01-28 CBR.mp3":        string(mpegFrames(100, 0)) + string(v1),
+		"2020-01-29 Tagged.mp3":     string(tag),
+		"2020-01-29 Tagged.mp3.txt": "The description file wins.",
+	})
+	defer os.RemoveAll(dir)
+
+	b := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{})
+	ps, err := b.ListPodcasts()
+	assert.NoError(err)
+
+	podcasts := map[string]pp.Podcast{}
+	for _, p := range ps {
+		podcasts[p.Details().Key] = p
+	}
+
+	vbr := podcasts["2020-01-27 VBR.mp3"].Details()
+	assert.Equal("Héllo", vbr.Title)
+	assert.Equal("The Host", vbr.Artist)
+	assert.Equal(7, vbr.Track)
+	assert.Equal("The comment.", vbr.Description)
+	assert.InDelta(1000*1152/44100.0, vbr.Duration.Seconds(), 0.001)
+	if assert.NotNil(vbr.EmbeddedArtwork) {
+		assert.Equal("image/png", vbr.EmbeddedArtwork.ContentType)
+
+		r, err := podcasts["2020-01-27 VBR.mp3"].(pp.ArtworkReader).ReadArtwork()
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.NoError(r.Close())
+		assert.Equal(artwork, data)
+	}
+
+	// the values of ID3v1 are used without ID3v2
+	cbr := podcasts["2020-01-28 CBR.mp3"].Details()
+	assert.Equal("ID3v1 title", cbr.Title)
+	assert.InDelta(100*417*8/128000.0, cbr.Duration.Seconds(), 0.001)
+	assert.Nil(cbr.EmbeddedArtwork)
+
+	tagged := podcasts["2020-01-29 Tagged.mp3"].Details()
+	assert.Equal("Héllo", tagged.Title)
+	assert.Equal("The description file wins.", tagged.Description)
+	assert.Equal(time.Duration(0), tagged.Duration)
+}
+
+// id3v23Chapter encodes a CHAP frame with a title.
+func id3v23Chapter(id string, start, end uint32, title string) []byte {
+	var b bytes.Buffer
+	b.WriteString(id + "\x00")
+	binary.Write(&b, binary.BigEndian, []uint32{start, end, 0xffffffff, 0xffffffff})
+	b.Write(id3v23Frame("TIT2", []byte("\x00"+title)))
+	return id3v23Frame("CHAP", b.Bytes())
+}
+
+func TestBackendFSChapters(t *testing.T) {
+	assert := assert.New(t)
+
+	tag := id3v23Tag(
+		// the table of contents decides the order
+		id3v23Frame("CTOC", []byte("toc\x00\x03\x02ch2\x00ch1\x00")),
+		id3v23Chapter("ch1", 0, 60000, "Intro"),
+		id3v23Chapter("ch2", 60000, 120000, "Outro"),
+		id3v23Chapter("unlisted", 30000, 40000, "Not in the table of contents"),
+	)
+
+	dir := newTestDir(t, map[string]string{
+		"2020-01-27 Tags.mp3": string(tag),
+		"2020-01-28 File.mp3": string(tag),
+		"2020-01-28 File.mp3.chapters.json": `{"version": "1.2.0", "chapters": [
+			{"startTime": 90.5, "title": "Second", "img": "ignored.jpg"},
+			{"startTime": 0, "title": "First", "url": "https://example.com"}
+		]}`,
+		"2020-01-29 Invalid.mp3":               string(tag),
+		"2020-01-29 Invalid.mp3.chapters.json": `{"chapters": [`,
+	})
+	defer os.RemoveAll(dir)
+
+	ps, err := pp.NewBackendFS(dir, "logo.png", nil, pp.Logger{}).ListPodcasts()
+	assert.NoError(err)
+	chapters := map[string][]pp.Chapter{}
+	for _, p := range ps {
+		chapters[p.Details().Key] = p.Details().Chapters
+	}
+
+	assert.Equal([]pp.Chapter{
+		{Start: time.Minute, End: 2 * time.Minute, Title: "Outro"},
+		{Start: 0, End: time.Minute, Title: "Intro"},
+	}, chapters["2020-01-27 Tags.mp3"])
+
+	// the chapters file takes precedence over the tags
+	assert.Equal([]pp.Chapter{
+		{Start: 0, Title: "First", URL: "https://example.com"},
+		{Start: 90*time.Second + 500*time.Millisecond, Title: "Second"},
+	}, chapters["2020-01-28 File.mp3"])
+
+	// an invalid chapters file is skipped, the chapters of the tags are kept
+	assert.Equal(chapters["2020-01-27 Tags.mp3"], chapters["2020-01-29 Invalid.mp3"])
+}
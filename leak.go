@@ -0,0 +1,40 @@
+package pp
+
+import "fmt"
+
+// SecretActivity is the activity of a single secret during some period of time.
+type SecretActivity struct {
+	UserID          string
+	Secret          string
+	UserAgents      int64
+	ClientIPs       int64
+	FeedRequests    int64
+	PodcastRequests int64
+}
+
+// LeakThresholds are the limits of activity a single secret may have during the
+// detection window before it's considered leaked (shared with others).
+// A threshold of zero is not checked.
+type LeakThresholds struct {
+	UserAgents      int64
+	ClientIPs       int64
+	PodcastRequests int64
+}
+
+// Check returns the reasons why the activity looks like the secret has leaked,
+// the secret is fine if no reasons are returned.
+func (t LeakThresholds) Check(a SecretActivity) []string {
+	var reasons []string
+
+	if t.UserAgents > 0 && a.UserAgents > t.UserAgents {
+		reasons = append(reasons, fmt.Sprintf("%v distinct user agents (limit %v)", a.UserAgents, t.UserAgents))
+	}
+	if t.ClientIPs > 0 && a.ClientIPs > t.ClientIPs {
+		reasons = append(reasons, fmt.Sprintf("%v distinct client IPs (limit %v)", a.ClientIPs, t.ClientIPs))
+	}
+	if t.PodcastRequests > 0 && a.PodcastRequests > t.PodcastRequests {
+		reasons = append(reasons, fmt.Sprintf("%v episode requests (limit %v)", a.PodcastRequests, t.PodcastRequests))
+	}
+
+	return reasons
+}
@@ -0,0 +1,18 @@
+package pp_test
+
+import (
+	"testing"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeakThresholdsCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	thresholds := pp.LeakThresholds{UserAgents: 3, ClientIPs: 5, PodcastRequests: 0}
+
+	assert.Empty(thresholds.Check(pp.SecretActivity{UserAgents: 3, ClientIPs: 5, PodcastRequests: 100000}))
+	assert.Len(thresholds.Check(pp.SecretActivity{UserAgents: 4, ClientIPs: 5}), 1)
+	assert.Len(thresholds.Check(pp.SecretActivity{UserAgents: 4, ClientIPs: 6}), 2)
+}
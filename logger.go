@@ -0,0 +1,240 @@
+package pp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message, the messages below the level of a
+// Logger are dropped.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level (debug, info, warn or error).
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", name)
+}
+
+// The formats of the log messages.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// redactedKeys are the keys whose values are never logged as is, they are
+// replaced by Redact.
+var redactedKeys = map[string]bool{
+	"secret":   true,
+	"cookie":   true,
+	"session":  true,
+	"token":    true,
+	"password": true,
+}
+
+// Redact returns a replacement for a credential that can be logged, the same
+// credential always has the same replacement so that log lines can still be
+// correlated.
+func Redact(credential string) string {
+	if credential == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(credential))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+// loggerOutput is shared by a Logger and the loggers derived from it.
+type loggerOutput struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	now    func() time.Time
+}
+
+// Logger writes leveled log messages with key-value pairs, as text or as a
+// JSON object per line. The values of keys such as secret and cookie are
+// redacted. The zero value discards everything.
+type Logger struct {
+	output *loggerOutput
+	// fields are the key-value pairs added by With
+	fields []interface{}
+}
+
+// NewLogger creates a logger that writes the messages at level or above to out
+// in the format (LogFormatText or LogFormatJSON).
+func NewLogger(out io.Writer, level Level, format string) (Logger, error) {
+	switch format {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return Logger{}, fmt.Errorf("invalid log format %q (expected %v or %v)", format, LogFormatText, LogFormatJSON)
+	}
+
+	return Logger{output: &loggerOutput{out: out, level: level, format: format, now: time.Now}}, nil
+}
+
+// With returns a logger that adds the key-value pairs to every message.
+func (l Logger) With(keyvals ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return Logger{output: l.output, fields: fields}
+}
+
+// Enabled returns true if the messages at level are written.
+func (l Logger) Enabled(level Level) bool {
+	return l.output != nil && level >= l.output.level
+}
+
+func (l Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+// logValue converts v to something that encodes well as JSON, key is used to
+// decide if the value has to be redacted.
+func logValue(key string, v interface{}) interface{} {
+	if redactedKeys[key] {
+		return Redact(fmt.Sprint(v))
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	case string, bool, int, int64, uint64, float64:
+		return v
+	case []string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+func (l Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	all = append(all, l.fields...)
+	all = append(all, keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "(missing)")
+	}
+
+	keys := make([]string, 0, len(all)/2)
+	values := make(map[string]interface{}, len(all)/2)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = logValue(key, all[i+1])
+	}
+
+	o := l.output
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := o.now().UTC().Format(time.RFC3339Nano)
+	if o.format == LogFormatJSON {
+		entry := make(map[string]interface{}, len(values)+3)
+		for key, value := range values {
+			entry[key] = value
+		}
+		entry["time"] = now
+		entry["level"] = level.String()
+		entry["msg"] = msg
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"time":%q,"level":"error","msg":"failed to encode log message","error":%q}`, now, err.Error()))
+		}
+		o.out.Write(append(line, '\n'))
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(now)
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, key := range keys {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(textValue(values[key]))
+	}
+	b.WriteByte('\n')
+	io.WriteString(o.out, b.String())
+}
+
+// textValue formats a value of the text format, it's quoted if it has to be.
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []string:
+		s = strings.Join(v, ",")
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+type loggerKey struct{}
+
+// ContextWithLogger returns a context that carries the logger, e.g. one with
+// the ID of the request that is being handled.
+func ContextWithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the logger of the context, fallback if it has none.
+func LoggerFromContext(ctx context.Context, fallback Logger) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return fallback
+}
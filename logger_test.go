@@ -0,0 +1,60 @@
+package pp_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	logger, err := pp.NewLogger(&out, pp.LevelInfo, pp.LogFormatJSON)
+	assert.NoError(err)
+
+	logger = logger.With("request_id", "abc")
+	logger.Debug("dropped")
+	logger.Warn("invalid secret", "secret", "hunter2", "error", errors.New("nope"), "count", 3)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !assert.Len(lines, 1) {
+		return
+	}
+
+	var entry map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal("warn", entry["level"])
+	assert.Equal("invalid secret", entry["msg"])
+	assert.Equal("abc", entry["request_id"])
+	assert.Equal("nope", entry["error"])
+	assert.Equal(float64(3), entry["count"])
+	assert.Equal(pp.Redact("hunter2"), entry["secret"])
+	assert.NotContains(lines[0], "hunter2")
+}
+
+func TestLoggerText(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	logger, err := pp.NewLogger(&out, pp.LevelDebug, pp.LogFormatText)
+	assert.NoError(err)
+
+	logger.Debug("updated podcasts", "channel", "default", "title", "Hello World!", "cookie", "abc")
+	line := out.String()
+	assert.Contains(line, ` DEBUG updated podcasts channel=default title="Hello World!" cookie=redacted:`)
+	assert.NotContains(line, "abc")
+
+	// the zero value discards everything
+	pp.Logger{}.Error("nothing")
+
+	_, err = pp.NewLogger(&out, pp.LevelDebug, "xml")
+	assert.Error(err)
+	_, err = pp.ParseLevel("verbose")
+	assert.Error(err)
+}
@@ -0,0 +1,72 @@
+package pp
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// mediaTypes are the content types of the supported episode formats by the
+// extension of the key, the extensions are matched case-insensitively.
+var mediaTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".opus": "audio/ogg",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".flac": "audio/flac",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+}
+
+// episodeExtension returns the extension of the key if it's an episode (in one
+// of the supported formats), otherwise it returns an empty string.
+func episodeExtension(key string) string {
+	ext := path.Ext(key)
+	if _, ok := mediaTypes[strings.ToLower(ext)]; !ok {
+		return ""
+	}
+	return ext
+}
+
+// isEpisode returns true if the key is an episode in one of the supported formats.
+func isEpisode(key string) bool {
+	return episodeExtension(key) != ""
+}
+
+// episodeExtensions returns the supported extensions for messages.
+func episodeExtensions() string {
+	exts := make([]string, 0, len(mediaTypes))
+	for ext := range mediaTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ", ")
+}
+
+// MediaType returns the content type of the episode with the key based on its
+// extension, audio/mpeg if the extension isn't known.
+func MediaType(key string) string {
+	contentType, ok := mediaTypes[strings.ToLower(path.Ext(key))]
+	if !ok {
+		return "audio/mpeg"
+	}
+	return contentType
+}
+
+// IsVideo returns true if the content type is a video.
+func IsVideo(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/")
+}
+
+// storedMediaType returns the content type stored with an episode (e.g. the
+// Content-Type of a S3 object) if it's an audio or video type, otherwise the
+// type is decided by the extension of the key.
+func storedMediaType(key, stored string) string {
+	stored = strings.TrimSpace(strings.SplitN(stored, ";", 2)[0])
+	if strings.HasPrefix(stored, "audio/") || strings.HasPrefix(stored, "video/") {
+		return stored
+	}
+	return MediaType(key)
+}
@@ -0,0 +1,372 @@
+package pp
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// migration is a single change to the schema of the SQL storages, the
+// statements are written for Postgres and rewritten for SQLite by rebind.
+//
+// The first migrations use IF NOT EXISTS because the databases created before
+// there were migrations already have (some of) their tables and columns.
+// Never change a migration that has been released, add a new one instead.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+	// upSQLite is used instead of up for SQLite if it is set
+	upSQLite []string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users and logs",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+				user_id    TEXT UNIQUE NOT NULL,
+				secret     TEXT UNIQUE NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+			`CREATE TABLE IF NOT EXISTS log_feed (
+				secret     TEXT NOT NULL,
+				referer    TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				timestamp  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+			`CREATE TABLE IF NOT EXISTS log_podcast (
+				secret     TEXT NOT NULL,
+				key        TEXT NOT NULL,
+				referer    TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				timestamp  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		},
+		down: []string{
+			`DROP TABLE log_podcast`,
+			`DROP TABLE log_feed`,
+			`DROP TABLE users`,
+		},
+	},
+	{
+		version: 2,
+		name:    "add access rules",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS access_rules (
+				rule       TEXT UNIQUE NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS hosted_domain TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE users DROP COLUMN IF EXISTS hosted_domain`,
+			`DROP TABLE access_rules`,
+		},
+	},
+	{
+		version: 3,
+		name:    "add secret history",
+		up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS secret_created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP`,
+			`CREATE TABLE IF NOT EXISTS secret_history (
+				user_id    TEXT NOT NULL,
+				secret     TEXT UNIQUE NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				reason     TEXT NOT NULL)`,
+		},
+		// SQLite can't add columns with a default of CURRENT_TIMESTAMP, the
+		// update leaves alone the secrets of a column that already existed
+		upSQLite: []string{
+			`ALTER TABLE users ADD COLUMN secret_created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00'`,
+			`UPDATE users SET secret_created_at = created_at WHERE secret_created_at = '1970-01-01 00:00:00'`,
+			`CREATE TABLE IF NOT EXISTS secret_history (
+				user_id    TEXT NOT NULL,
+				secret     TEXT UNIQUE NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				reason     TEXT NOT NULL)`,
+		},
+		down: []string{
+			`DROP TABLE secret_history`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS secret_created_at`,
+		},
+	},
+	{
+		version: 4,
+		name:    "add roles and suspensions",
+		up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_reason TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE users DROP COLUMN IF EXISTS suspended_reason`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS role`,
+		},
+	},
+	{
+		version: 5,
+		name:    "add channels",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS channel_access (
+				user_id    TEXT NOT NULL,
+				channel    TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (user_id, channel))`,
+			// the rows logged before channels existed have an empty channel
+			`ALTER TABLE log_feed ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE log_podcast ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE log_podcast DROP COLUMN IF EXISTS channel`,
+			`ALTER TABLE log_feed DROP COLUMN IF EXISTS channel`,
+			`DROP TABLE channel_access`,
+		},
+	},
+	{
+		version: 6,
+		name:    "log client IPs",
+		up: []string{
+			`ALTER TABLE log_feed ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE log_podcast ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE log_podcast DROP COLUMN IF EXISTS client_ip`,
+			`ALTER TABLE log_feed DROP COLUMN IF EXISTS client_ip`,
+		},
+	},
+	{
+		version: 7,
+		name:    "add sessions",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS sessions (
+				session_id TEXT UNIQUE NOT NULL,
+				user_id    TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				client_ip  TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				last_seen  TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL)`,
+		},
+		down: []string{
+			`DROP TABLE sessions`,
+		},
+	},
+}
+
+// MigrationStatus is the status of a single migration of the schema.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is zero if the migration hasn't been applied
+	AppliedAt time.Time
+}
+
+// Migrator is implemented by the storages that have a schema, Init applies
+// all pending migrations.
+type Migrator interface {
+	// MigrateUp applies all migrations that haven't been applied yet.
+	MigrateUp() error
+	// MigrateDown reverts the latest applied migration.
+	MigrateDown() error
+	// MigrationStatus returns the status of every known migration, oldest first.
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+func (s storageSQL) createSchemaVersion() error {
+	_, err := s.exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version    INTEGER UNIQUE NOT NULL,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+
+	return nil
+}
+
+// schemaVersion returns the version of the latest applied migration, zero if
+// none have been applied. It locks the schema until the end of tx so that two
+// instances starting at the same time don't apply the same migration.
+func (s storageSQL) schemaVersion(tx *sql.Tx) (int, error) {
+	if !s.sqlite {
+		_, err := tx.Exec(`LOCK TABLE schema_version IN EXCLUSIVE MODE`)
+		if err != nil {
+			return 0, fmt.Errorf("failed to lock schema_version: %v", err)
+		}
+	}
+
+	var version sql.NullInt64
+	err := tx.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query db: %v", err)
+	}
+
+	return int(version.Int64), nil
+}
+
+// addColumn matches the statements that add a column to a table.
+var addColumn = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+
+// sqliteColumnExists returns whether statement adds a column that already
+// exists. SQLite has no ADD COLUMN IF NOT EXISTS, and the databases created
+// by Init before there were migrations already have all the columns.
+func sqliteColumnExists(tx *sql.Tx, statement string) (bool, error) {
+	match := addColumn.FindStringSubmatch(statement)
+	if match == nil {
+		return false, nil
+	}
+
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, match[1], match[2]).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to query db: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// migrate applies (or reverts if up is false) a single migration in a
+// transaction, it does nothing if another instance already did it.
+func (s storageSQL) migrate(m migration, up bool) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	version, err := s.schemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if (up && version != m.version-1) || (!up && version != m.version) {
+		return false, nil
+	}
+
+	statements := m.down
+	if up {
+		statements = m.up
+		if s.sqlite && m.upSQLite != nil {
+			statements = m.upSQLite
+		}
+	}
+	for _, statement := range statements {
+		if s.sqlite && up {
+			exists, err := sqliteColumnExists(tx, statement)
+			if err != nil {
+				return false, fmt.Errorf("failed to migrate to version %v (%v): %v", m.version, m.name, err)
+			}
+			if exists {
+				continue
+			}
+		}
+
+		_, err := tx.Exec(s.rebind(statement))
+		if err != nil {
+			return false, fmt.Errorf("failed to migrate to version %v (%v): %v", m.version, m.name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(
+			s.rebind(`INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)`),
+			m.version, m.name, time.Now().UTC())
+	} else {
+		_, err = tx.Exec(s.rebind(`DELETE FROM schema_version WHERE version = $1`), m.version)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update schema_version: %v", err)
+	}
+
+	return true, tx.Commit()
+}
+
+func (s storageSQL) MigrateUp() error {
+	err := s.createSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		applied, err := s.migrate(m, true)
+		if err != nil {
+			return err
+		}
+		if applied {
+			s.log.Info("migrated the database", "version", m.version, "name", m.name)
+		}
+	}
+
+	return nil
+}
+
+func (s storageSQL) MigrateDown() error {
+	err := s.createSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	var version sql.NullInt64
+	err = s.queryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to query db: %v", err)
+	}
+	if !version.Valid {
+		return errors.New("no migrations have been applied")
+	}
+
+	for _, m := range migrations {
+		if m.version != int(version.Int64) {
+			continue
+		}
+
+		reverted, err := s.migrate(m, false)
+		if err != nil {
+			return err
+		}
+		if !reverted {
+			return errors.New("the schema was migrated concurrently, try again")
+		}
+
+		s.log.Info("reverted a database migration", "version", m.version, "name", m.name)
+		return nil
+	}
+
+	return fmt.Errorf("the database has an unknown version %v, it was migrated by a newer version of this application", version.Int64)
+}
+
+func (s storageSQL) MigrationStatus() ([]MigrationStatus, error) {
+	err := s.createSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.query(`SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		out = append(out, MigrationStatus{m.version, m.name, applied[m.version]})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,133 @@
+package pp_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSQLite(t)
+	defer cleanup()
+
+	status, err := s.MigrationStatus()
+	assert.NoError(err)
+	for _, m := range status {
+		assert.False(m.AppliedAt.IsZero(), "migration %v has not been applied", m.Version)
+	}
+
+	// every migration can be reverted and applied again
+	for range status {
+		assert.NoError(s.MigrateDown())
+	}
+	assert.Error(s.MigrateDown())
+
+	status, err = s.MigrationStatus()
+	assert.NoError(err)
+	for _, m := range status {
+		assert.True(m.AppliedAt.IsZero(), "migration %v has not been reverted", m.Version)
+	}
+
+	assert.NoError(s.MigrateUp())
+	assert.NoError(s.MigrateUp())
+
+	secret, err := s.CreateUser("alice@example.com", "")
+	assert.NoError(err)
+	user, ok, err := s.UserBySecret(secret)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(pp.RoleUser, user.Role)
+
+	users, err := s.Users()
+	assert.NoError(err)
+	if assert.Len(users, 1) {
+		assert.False(users[0].SecretCreatedAt.IsZero())
+		assert.True(users[0].SecretCreatedAt.Year() > 1970)
+	}
+}
+
+// preMigrationSchema is the schema that StorageSQLite.Init created before
+// there were migrations, it has every column but no schema_version.
+var preMigrationSchema = []string{
+	`CREATE TABLE users (
+		user_id           TEXT UNIQUE NOT NULL,
+		secret            TEXT UNIQUE NOT NULL,
+		created_at        TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		hosted_domain     TEXT NOT NULL DEFAULT '',
+		secret_created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		role              TEXT NOT NULL DEFAULT 'user',
+		suspended_reason  TEXT)`,
+	`CREATE TABLE log_feed (
+		secret     TEXT NOT NULL,
+		referer    TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		timestamp  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		channel    TEXT NOT NULL DEFAULT '',
+		client_ip  TEXT NOT NULL DEFAULT '')`,
+	`CREATE TABLE log_podcast (
+		secret     TEXT NOT NULL,
+		key        TEXT NOT NULL,
+		referer    TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		timestamp  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		channel    TEXT NOT NULL DEFAULT '',
+		client_ip  TEXT NOT NULL DEFAULT '')`,
+	`CREATE TABLE access_rules (
+		rule       TEXT UNIQUE NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+	`CREATE TABLE secret_history (
+		user_id    TEXT NOT NULL,
+		secret     TEXT UNIQUE NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		reason     TEXT NOT NULL)`,
+	`CREATE TABLE channel_access (
+		user_id    TEXT NOT NULL,
+		channel    TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, channel))`,
+	`INSERT INTO users (user_id, secret, created_at, secret_created_at)
+		VALUES ('alice@example.com', 'secret', '2020-01-01 00:00:00', '2020-06-01 00:00:00')`,
+}
+
+func TestMigrationsPreMigrationSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pp-sqlite-*")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pp.db")
+
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(err)
+	for _, statement := range preMigrationSchema {
+		_, err := db.Exec(statement)
+		assert.NoError(err)
+	}
+	assert.NoError(db.Close())
+
+	s, err := pp.NewStorageSQLite(path, pp.Logger{})
+	assert.NoError(err)
+	assert.NoError(s.MigrateUp())
+
+	status, err := s.MigrationStatus()
+	assert.NoError(err)
+	for _, m := range status {
+		assert.False(m.AppliedAt.IsZero(), "migration %v has not been applied", m.Version)
+	}
+
+	// the existing users keep the time their secret was created
+	users, err := s.Users()
+	assert.NoError(err)
+	if assert.Len(users, 1) {
+		assert.Equal(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), users[0].SecretCreatedAt.UTC())
+	}
+}
@@ -1,6 +1,9 @@
 package pp
 
 import (
+	"crypto/sha1"
+	"fmt"
+	"io"
 	"net/http"
 	"time"
 )
@@ -10,10 +13,59 @@ type Podcast interface {
 	HandlePodcast(http.ResponseWriter, *http.Request) error
 }
 
+// PodcastDetails are the details of an episode. The fields after ContentType
+// are read from the ID3 tags of MP3 files (see readID3) or set by a sidecar
+// (see applySidecar), they are zero otherwise.
 type PodcastDetails struct {
-	Key         string
-	Title       string
-	Published   time.Time
+	Key       string
+	Title     string
+	Published time.Time
+	// Expires is when the episode is taken down, it's zero if it never is
+	Expires     time.Time
 	Size        int64
 	Description string
+	// ContentType is the content type of the episode, e.g. audio/mpeg
+	ContentType string
+
+	Artist   string
+	Track    int
+	Episode  int
+	Season   int
+	Explicit bool
+	Duration time.Duration
+	// Artwork is either an absolute URL or the key of an image in the backend
+	// (relative to the prefix, like the logo), it's served by GetFile
+	Artwork string
+	// EmbeddedArtwork is the artwork in the episode file, it's used when
+	// Artwork is empty and served by ArtworkReader
+	EmbeddedArtwork *EmbeddedArtwork
+	// Chapters are read from the ID3 tags or the chapters file of the episode
+	Chapters []Chapter
+	// Transcripts are the transcripts next to the episode file
+	Transcripts []Transcript
+	// GUID is the GUID of the episode in the feed, it's set by the sidecar or
+	// by the catalog (see Catalog.Identify). If it's empty KeyGUID is used.
+	GUID string
+}
+
+// ArtworkReader is implemented by the podcasts that can read the artwork
+// embedded in their file (see PodcastDetails.EmbeddedArtwork).
+type ArtworkReader interface {
+	ReadArtwork() (io.ReadCloser, error)
+}
+
+// guidNamespace is the namespace of the name-based UUIDs returned by KeyGUID.
+var guidNamespace = [16]byte{0xa9, 0xcf, 0xff, 0x57, 0xe9, 0xba, 0x4a, 0x73, 0x81, 0xb1, 0xb4, 0xec, 0x5c, 0x44, 0x89, 0x7a}
+
+// KeyGUID returns the GUID derived from the key of an episode, a name-based
+// (version 5) UUID, which is the same every time for the same key.
+func KeyGUID(key string) string {
+	h := sha1.New()
+	h.Write(guidNamespace[:])
+	h.Write([]byte(key))
+	u := h.Sum(nil)[:16]
+
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
 }
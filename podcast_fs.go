@@ -0,0 +1,167 @@
+package pp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+type PodcastFS struct {
+	backend *BackendFS
+	details PodcastDetails
+}
+
+// readPodcastFSDetails reads the details of the podcast from the file system,
+// the returned bool is false if some of the details could not be read (and the
+// details should therefore not be cached). exists is used to check which of the
+// other files of the podcast (e.g. the sidecar) exist.
+func readPodcastFSDetails(backend *BackendFS, key string, info os.FileInfo, exists func(string) bool) (PodcastDetails, bool, error) {
+	published, title, err := splitTitle(key, backend.loc)
+	if err != nil {
+		return PodcastDetails{}, false, err
+	}
+
+	complete := true
+
+	details := PodcastDetails{
+		Key:         key,
+		Title:       title,
+		Published:   published,
+		Size:        info.Size(),
+		ContentType: MediaType(key),
+	}
+
+	if details.ContentType == "audio/mpeg" {
+		tags, err := readPodcastFSTags(backend, key, info.Size())
+		if err == nil {
+			details = tags.apply(details)
+		} else {
+			backend.log.Warn("failed to read ID3 tags of PodcastFS", "key", key, "error", err)
+			complete = false
+		}
+	}
+
+	descriptionPath, err := backend.path(key + ".txt")
+	if err == nil {
+		desc, err := ioutil.ReadFile(descriptionPath)
+		if err == nil {
+			details.Description = string(desc)
+		} else if !os.IsNotExist(err) {
+			backend.log.Warn("failed to read description of PodcastFS", "key", key+".txt", "error", err)
+			complete = false
+		}
+	}
+
+	chaptersPath, err := backend.path(key + chaptersSuffix)
+	if err == nil {
+		data, err := ioutil.ReadFile(chaptersPath)
+		if err == nil {
+			chapters, err := parseChapters(data)
+			if err == nil {
+				details.Chapters = chapters
+			} else {
+				// the file is part of the version, so it's parsed again once it's fixed
+				backend.log.Warn("invalid chapters of PodcastFS", "key", key+chaptersSuffix, "error", err)
+			}
+		} else if !os.IsNotExist(err) {
+			backend.log.Warn("failed to read chapters of PodcastFS", "key", key+chaptersSuffix, "error", err)
+			complete = false
+		}
+	}
+
+	details.Transcripts = transcripts(key, "", exists)
+
+	if sidecar := sidecarKey(key, exists); sidecar != "" {
+		// unlike the description the sidecar can't be left out, it might
+		// for example move the publishing date to the future
+		sidecarPath, err := backend.path(sidecar)
+		if err != nil {
+			return PodcastDetails{}, false, err
+		}
+		data, err := ioutil.ReadFile(sidecarPath)
+		if err != nil {
+			return PodcastDetails{}, false, fmt.Errorf("failed to read sidecar of PodcastFS key=%q: %v", sidecar, err)
+		}
+		details, err = applySidecar(details, data, backend.loc)
+		if err != nil {
+			return PodcastDetails{}, false, err
+		}
+	}
+
+	return details, complete, nil
+}
+
+// readPodcastFSTags reads the ID3 tags of the podcast.
+func readPodcastFSTags(backend *BackendFS, key string, size int64) (id3Tags, error) {
+	path, err := backend.path(key)
+	if err != nil {
+		return id3Tags{}, err
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return id3Tags{}, err
+	}
+	defer fp.Close()
+
+	return readID3(func(offset, length int64) ([]byte, error) {
+		b := make([]byte, length)
+		_, err := io.ReadFull(io.NewSectionReader(fp, offset, length), b)
+		return b, err
+	}, size)
+}
+
+func (p PodcastFS) Details() PodcastDetails {
+	return p.details
+}
+
+func (p PodcastFS) ReadArtwork() (io.ReadCloser, error) {
+	artwork := p.details.EmbeddedArtwork
+	if artwork == nil {
+		return nil, fmt.Errorf("PodcastFS key=%q has no embedded artwork", p.details.Key)
+	}
+
+	path, err := p.backend.path(p.details.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file of PodcastFS key=%q: %v", p.details.Key, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(fp, artwork.Offset, artwork.Size), fp}, nil
+}
+
+// HandlePodcast serves the file with http.ServeContent, which takes care of
+// Range (and If-Range, If-Modified-Since, ...) headers for us.
+func (p PodcastFS) HandlePodcast(w http.ResponseWriter, r *http.Request) error {
+	key := p.details.Key
+
+	path, err := p.backend.path(key)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file of PodcastFS key=%q: %v", key, err)
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file of PodcastFS key=%q: %v", key, err)
+	}
+
+	w.Header().Set("Content-Type", p.details.ContentType)
+	http.ServeContent(w, r, key, info.ModTime(), fp)
+
+	return nil
+}
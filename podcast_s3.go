@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,7 +14,13 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-func splitTitle(name string) (time.Time, string, error) {
+// keyLayouts are the layouts of the published date (and time) at the start of
+// a key, e.g. "2020-01-27 Hello.mp3" or "2020-01-27T0930 Hello.mp3".
+var keyLayouts = []string{"2006-01-02", "2006-01-02T1504", "2006-01-02T150405", "2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// splitTitle splits the name of a podcast to its published time, in loc, and
+// its title.
+func splitTitle(name string, loc *time.Location) (time.Time, string, error) {
 	var (
 		t     time.Time
 		title string
@@ -28,85 +33,196 @@ func splitTitle(name string) (time.Time, string, error) {
 	}
 
 	published := split[0]
-	t, err = time.Parse("2006-01-02", published)
+	for _, layout := range keyLayouts {
+		t, err = time.ParseInLocation(layout, published, loc)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		return t, title, fmt.Errorf("invalid date format (expected YYYY-MM-DD): %v", published)
+		return t, title, fmt.Errorf("invalid date format (expected YYYY-MM-DD or YYYY-MM-DDTHHMM): %v", published)
 	}
 
 	title = split[1]
-	if !strings.HasSuffix(title, ".mp3") {
-		return t, title, fmt.Errorf("invalid title (expected it to end with .mp3): %v", title)
+	ext := episodeExtension(title)
+	if ext == "" {
+		return t, title, fmt.Errorf("invalid title (expected it to end with one of %v): %v", episodeExtensions(), title)
 	}
 
-	return t, title[:len(title)-len(".mp3")], nil
+	return t, title[:len(title)-len(ext)], nil
 }
 
 type PodcastS3 struct {
-	backend     *BackendS3
-	key         string
-	size        int64
-	published   time.Time
-	title       string
-	description string
+	backend *BackendS3
+	details PodcastDetails
 }
 
-func newPodcastS3(backend *BackendS3, key string, size *int64) (Podcast, error) {
+// fetchPodcastS3Details fetches the details of the podcast from S3, exists
+// tells which of the other files of the podcast (e.g. the description) exist
+// and should be fetched. The returned bool is false if some of the details
+// could not be fetched (and the details should therefore not be cached).
+func fetchPodcastS3Details(backend *BackendS3, key string, size *int64, exists func(string) bool) (PodcastDetails, bool, error) {
 	if size == nil {
-		return PodcastS3{}, errors.New("size must be set: size is nil")
+		return PodcastDetails{}, false, errors.New("size must be set: size is nil")
 	}
 
-	published, title, err := splitTitle(key)
+	published, title, err := splitTitle(strings.TrimPrefix(key, backend.prefix), backend.loc)
 	if err != nil {
-		return PodcastS3{}, err
+		return PodcastDetails{}, false, err
+	}
+
+	complete := true
+
+	details := PodcastDetails{
+		Key:         key,
+		Title:       title,
+		Published:   published,
+		Size:        *size,
+		ContentType: MediaType(key),
 	}
 
+	var metadataTitle *string
 	head, err := backend.s3.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(backend.bucket),
 		Key:    aws.String(key),
 	})
 	if err == nil {
-		v, ok := head.Metadata["Title"]
-		if ok && v != nil {
-			log.Printf("rewriting title with the value of x-amz-meta-title %q", *v)
-			title = *v
-		}
+		details.ContentType = storedMediaType(key, aws.StringValue(head.ContentType))
+		metadataTitle = head.Metadata["Title"]
 	} else {
-		log.Printf("failed to get metadata of PodcastS3 key=%q: %v", key, err)
+		backend.log.Warn("failed to get metadata of PodcastS3", "key", key, "error", err)
+		complete = false
 	}
 
-	descriptionKey := key + ".txt"
-	var description string
-	obj, err := backend.s3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(backend.bucket),
-		Key:    aws.String(descriptionKey),
-	})
-	if err == nil {
-		defer obj.Body.Close()
-		desc, err := ioutil.ReadAll(obj.Body)
+	if details.ContentType == "audio/mpeg" {
+		tags, err := readID3(backend.rangeReader(key), *size)
 		if err == nil {
-			description = string(desc)
+			details = tags.apply(details)
 		} else {
-			log.Printf("failed to read description of PodcastS3 key=%q: %v", descriptionKey, err)
+			backend.log.Warn("failed to read ID3 tags of PodcastS3", "key", key, "error", err)
+			complete = false
 		}
-	} else {
-		log.Printf("failed to get description of PodcastS3 key=%q: %v", descriptionKey, err)
 	}
 
-	return PodcastS3{backend, key, *size, published, title, description}, nil
+	// the metadata title is set explicitly, so it takes precedence over the tags
+	if metadataTitle != nil {
+		backend.log.Debug("rewriting title with the value of x-amz-meta-title", "key", key, "title", *metadataTitle)
+		details.Title = *metadataTitle
+	}
+
+	if exists(key + ".txt") {
+		descriptionKey := key + ".txt"
+		obj, err := backend.s3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(descriptionKey),
+		})
+		if err == nil {
+			defer obj.Body.Close()
+			desc, err := ioutil.ReadAll(obj.Body)
+			if err == nil {
+				details.Description = string(desc)
+			} else {
+				backend.log.Warn("failed to read description of PodcastS3", "key", descriptionKey, "error", err)
+				complete = false
+			}
+		} else {
+			backend.log.Warn("failed to get description of PodcastS3", "key", descriptionKey, "error", err)
+			complete = false
+		}
+	}
+
+	if chaptersKey := key + chaptersSuffix; exists(chaptersKey) {
+		data, err := backend.getObject(chaptersKey)
+		if err == nil {
+			chapters, err := parseChapters(data)
+			if err == nil {
+				details.Chapters = chapters
+			} else {
+				// the object is part of the version, so it's parsed again once it's fixed
+				backend.log.Warn("invalid chapters of PodcastS3", "key", chaptersKey, "error", err)
+			}
+		} else {
+			backend.log.Warn("failed to get chapters of PodcastS3", "key", chaptersKey, "error", err)
+			complete = false
+		}
+	}
+
+	details.Transcripts = transcripts(key, backend.prefix, exists)
+
+	if sidecar := sidecarKey(key, exists); sidecar != "" {
+		// unlike the description the sidecar can't be left out, it might
+		// for example move the publishing date to the future
+		data, err := backend.getObject(sidecar)
+		if err != nil {
+			return PodcastDetails{}, false, fmt.Errorf("failed to get sidecar of PodcastS3 key=%q: %v", sidecar, err)
+		}
+		details, err = applySidecar(details, data, backend.loc)
+		if err != nil {
+			return PodcastDetails{}, false, err
+		}
+	}
+
+	return details, complete, nil
+}
+
+// getObject returns the content of the object with the key.
+func (b *BackendS3) getObject(key string) ([]byte, error) {
+	obj, err := b.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	return ioutil.ReadAll(obj.Body)
+}
+
+// rangeReader returns a rangeReader that fetches the ranges of the object with
+// Range requests.
+func (b *BackendS3) rangeReader(key string) rangeReader {
+	return func(offset, length int64) ([]byte, error) {
+		obj, err := b.s3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(fmt.Sprintf("bytes=%v-%v", offset, offset+length-1)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Body.Close()
+
+		data := make([]byte, length)
+		_, err = io.ReadFull(obj.Body, data)
+		return data, err
+	}
 }
 
 func (p PodcastS3) Details() PodcastDetails {
-	return PodcastDetails{
-		Key:         p.key,
-		Title:       p.title,
-		Published:   p.published,
-		Size:        p.size,
-		Description: p.description,
+	return p.details
+}
+
+func (p PodcastS3) ReadArtwork() (io.ReadCloser, error) {
+	artwork := p.details.EmbeddedArtwork
+	if artwork == nil {
+		return nil, fmt.Errorf("PodcastS3 key=%q has no embedded artwork", p.details.Key)
 	}
+
+	obj, err := p.backend.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(p.backend.bucket),
+		Key:    aws.String(p.details.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", artwork.Offset, artwork.Offset+artwork.Size-1)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get artwork from S3: %v", err)
+	}
+
+	return obj.Body, nil
 }
 
 func (p PodcastS3) HandlePodcast(w http.ResponseWriter, r *http.Request) error {
-	w.Header().Add("Content-Type", "audio/mpeg")
+	w.Header().Add("Content-Type", p.details.ContentType)
 	w.Header().Add("Accept-Ranges", "bytes")
 
 	rangeHeader := r.Header.Get("Range")
@@ -118,11 +234,11 @@ func (p PodcastS3) HandlePodcast(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (p PodcastS3) handleRangeHeader(w http.ResponseWriter, r *http.Request, rangeHeader string) error {
-	log.Printf("request with Range header: %v", rangeHeader)
+	p.backend.log.Debug("request with Range header", "key", p.details.Key, "range", rangeHeader)
 
 	obj, err := p.backend.s3.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(p.backend.bucket),
-		Key:    aws.String(p.key),
+		Key:    aws.String(p.details.Key),
 		Range:  aws.String(rangeHeader),
 	})
 	if err != nil {
@@ -132,7 +248,7 @@ func (p PodcastS3) handleRangeHeader(w http.ResponseWriter, r *http.Request, ran
 
 	contentLength, contentRange := obj.ContentLength, obj.ContentRange
 	if contentLength == nil || contentRange == nil {
-		return fmt.Errorf("S3 returned nil Content-Length (=%q) and/or Content-Range (=%q)", contentLength, contentRange)
+		return fmt.Errorf("S3 returned nil Content-Length (nil=%v) and/or Content-Range (nil=%v)", contentLength == nil, contentRange == nil)
 	}
 
 	w.Header().Set("Content-Length", strconv.FormatInt(*contentLength, 10))
@@ -150,7 +266,7 @@ func (p PodcastS3) handleRangeHeader(w http.ResponseWriter, r *http.Request, ran
 func (p PodcastS3) handleNormal(w http.ResponseWriter, r *http.Request) error {
 	obj, err := p.backend.s3.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(p.backend.bucket),
-		Key:    aws.String(p.key),
+		Key:    aws.String(p.details.Key),
 	})
 	if err != nil {
 		return fmt.Errorf("failed get object from S3: %v", err)
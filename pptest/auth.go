@@ -0,0 +1,68 @@
+package pptest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/polarpayne/pp"
+)
+
+// Auth is a pp.Auth that doesn't talk to any provider, the URL returned by
+// AuthURL contains the state and the code that logs in as the identity given
+// to Login (like the provider would after the user has logged in).
+type Auth struct {
+	// URL is the base of the URLs returned by AuthURL
+	URL string
+
+	mutex  sync.Mutex
+	logins map[string]login
+	codes  int
+}
+
+type login struct {
+	identity      pp.Identity
+	codeChallenge string
+}
+
+func NewAuth(authURL string) *Auth {
+	return &Auth{URL: authURL, logins: make(map[string]login)}
+}
+
+// Login returns a code that Identify exchanges to identity, the code is only
+// valid with the verifier of codeChallenge.
+func (a *Auth) Login(identity pp.Identity, codeChallenge string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.codes++
+	code := fmt.Sprintf("code-%v", a.codes)
+	a.logins[code] = login{identity, codeChallenge}
+
+	return code
+}
+
+func (a *Auth) AuthURL(state, codeChallenge string) string {
+	return a.URL + "?" + url.Values{"state": {state}, "code_challenge": {codeChallenge}}.Encode()
+}
+
+func (a *Auth) Identify(ctx context.Context, code, codeVerifier string) (pp.Identity, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	l, ok := a.logins[code]
+	if !ok {
+		return pp.Identity{}, fmt.Errorf("invalid code %q", code)
+	}
+	delete(a.logins, code)
+
+	hash := sha256.Sum256([]byte(codeVerifier))
+	if base64.RawURLEncoding.EncodeToString(hash[:]) != l.codeChallenge {
+		return pp.Identity{}, fmt.Errorf("invalid code verifier for code %q", code)
+	}
+
+	return l.identity, nil
+}
@@ -0,0 +1,166 @@
+// Package pptest provides in-memory implementations of the interfaces of pp
+// (Storage, Backend, Podcast and Auth) for testing code that uses them.
+package pptest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/polarpayne/pp"
+)
+
+// Backend is an in-memory pp.Backend, podcasts can be added and removed while
+// it's being used.
+type Backend struct {
+	logo []byte
+
+	mutex    sync.Mutex
+	podcasts []*Podcast
+	files    map[string][]byte
+	err      error
+}
+
+func NewBackend(logo []byte, podcasts ...*Podcast) *Backend {
+	return &Backend{logo: logo, podcasts: podcasts}
+}
+
+// Add adds the podcast to the backend, a podcast with the same key is replaced.
+func (b *Backend) Add(p *Podcast) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, existing := range b.podcasts {
+		if existing.details.Key == p.details.Key {
+			b.podcasts[i] = p
+			return
+		}
+	}
+	b.podcasts = append(b.podcasts, p)
+}
+
+// AddFile adds a file (such as the artwork of an episode) that is returned by GetFile.
+func (b *Backend) AddFile(key string, content []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.files == nil {
+		b.files = make(map[string][]byte)
+	}
+	b.files[key] = content
+}
+
+// Remove removes the podcast with the given key from the backend.
+func (b *Backend) Remove(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, p := range b.podcasts {
+		if p.details.Key == key {
+			b.podcasts = append(b.podcasts[:i], b.podcasts[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetError makes ListPodcasts and GetPodcast fail with err, nil makes them work again.
+func (b *Backend) SetError(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.err = err
+}
+
+func (b *Backend) GetLogo() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b.logo)), nil
+}
+
+func (b *Backend) ListPodcasts() ([]pp.Podcast, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	out := make([]pp.Podcast, 0, len(b.podcasts))
+	for _, p := range b.podcasts {
+		out = append(out, p)
+	}
+
+	return out, nil
+}
+
+func (b *Backend) GetPodcast(key string) (pp.Podcast, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	for _, p := range b.podcasts {
+		if p.details.Key == key {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("podcast %q does not exist", key)
+}
+
+func (b *Backend) GetFile(key string) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	content, ok := b.files[key]
+	if !ok {
+		return nil, fmt.Errorf("file %q does not exist", key)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Podcast is an in-memory pp.Podcast.
+type Podcast struct {
+	details pp.PodcastDetails
+	content []byte
+}
+
+// NewPodcast creates a podcast with the given content, the size of the details
+// is set to the length of the content if it's zero and the content type is
+// decided by the key if it's empty.
+func NewPodcast(details pp.PodcastDetails, content []byte) *Podcast {
+	if details.Size == 0 {
+		details.Size = int64(len(content))
+	}
+	if details.ContentType == "" {
+		details.ContentType = pp.MediaType(details.Key)
+	}
+
+	return &Podcast{details, content}
+}
+
+func (p *Podcast) Details() pp.PodcastDetails {
+	return p.details
+}
+
+func (p *Podcast) ReadArtwork() (io.ReadCloser, error) {
+	artwork := p.details.EmbeddedArtwork
+	if artwork == nil {
+		return nil, fmt.Errorf("podcast %q has no embedded artwork", p.details.Key)
+	}
+
+	return ioutil.NopCloser(io.NewSectionReader(bytes.NewReader(p.content), artwork.Offset, artwork.Size)), nil
+}
+
+// HandlePodcast serves the content with http.ServeContent, so Range requests
+// work the same as with the real backends.
+func (p *Podcast) HandlePodcast(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", p.details.ContentType)
+	http.ServeContent(w, r, p.details.Key, p.details.Published, bytes.NewReader(p.content))
+
+	return nil
+}
@@ -0,0 +1,592 @@
+package pptest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/polarpayne/pp"
+)
+
+// LogEntry is a single request logged by LogFeed or LogPodcast, Key is empty
+// for feed requests.
+type LogEntry struct {
+	Secret    string
+	Channel   string
+	Key       string
+	Referer   string
+	UserAgent string
+	ClientIP  string
+	Timestamp time.Time
+}
+
+type user struct {
+	pp.User
+	secret          string
+	secretCreatedAt time.Time
+}
+
+// Storage is an in-memory pp.Storage with the same semantics as the SQL
+// storages, the zero value is not usable, use NewStorage.
+type Storage struct {
+	mutex sync.Mutex
+
+	users      map[string]*user
+	history    []pp.SecretEvent
+	rules      map[string]bool
+	channels   map[string]map[string]bool
+	sessions   map[string]pp.Session
+	feedLog    []LogEntry
+	podcastLog []LogEntry
+	pingErr    error
+}
+
+func NewStorage() *Storage {
+	return &Storage{
+		users:    make(map[string]*user),
+		rules:    make(map[string]bool),
+		channels: make(map[string]map[string]bool),
+		sessions: make(map[string]pp.Session),
+	}
+}
+
+// FeedLog returns the feed requests logged so far.
+func (s *Storage) FeedLog() []LogEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]LogEntry(nil), s.feedLog...)
+}
+
+// PodcastLog returns the episode requests logged so far.
+func (s *Storage) PodcastLog() []LogEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]LogEntry(nil), s.podcastLog...)
+}
+
+// SetPingError makes Ping fail with err, nil makes it work again.
+func (s *Storage) SetPingError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pingErr = err
+}
+
+func (s *Storage) Init() error {
+	return nil
+}
+
+func (s *Storage) Ping() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.pingErr
+}
+
+func (s *Storage) CreateUser(userID, hostedDomain string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.HostedDomain = hostedDomain
+		return u.secret, nil
+	}
+
+	now := time.Now()
+	s.users[userID] = &user{
+		User:            pp.User{ID: userID, HostedDomain: hostedDomain, Role: pp.RoleUser, CreatedAt: now},
+		secret:          pp.GenerateSecret(),
+		secretCreatedAt: now,
+	}
+
+	return s.users[userID].secret, nil
+}
+
+// userBySecret must be called with the mutex locked.
+func (s *Storage) userBySecret(secret string) (*user, bool) {
+	for _, u := range s.users {
+		if u.secret == secret {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// user must be called with the mutex locked.
+func (s *Storage) user(userID string) (*user, error) {
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("user %q does not exist", userID)
+	}
+	return u, nil
+}
+
+func (s *Storage) UserBySecret(secret string) (pp.User, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.userBySecret(secret)
+	if !ok {
+		return pp.User{}, false, nil
+	}
+	return u.User, true, nil
+}
+
+func (s *Storage) UserSecret(userID string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return "", err
+	}
+	return u.secret, nil
+}
+
+func (s *Storage) CreateSession(userID, userAgent, clientIP string, expiresAt time.Time) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	cookie := pp.GenerateSecret()
+	s.sessions[pp.SessionID(cookie)] = pp.Session{
+		ID:        pp.SessionID(cookie),
+		UserID:    userID,
+		UserAgent: userAgent,
+		ClientIP:  clientIP,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: expiresAt,
+	}
+
+	return cookie, nil
+}
+
+func (s *Storage) SessionUser(cookie string, idleTimeout time.Duration) (pp.User, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	session, ok := s.sessions[pp.SessionID(cookie)]
+	if !ok || !session.ExpiresAt.After(now) || !session.LastSeen.After(now.Add(-idleTimeout)) {
+		return pp.User{}, false, nil
+	}
+
+	u, ok := s.users[session.UserID]
+	if !ok {
+		return pp.User{}, false, nil
+	}
+
+	session.LastSeen = now
+	s.sessions[session.ID] = session
+
+	return u.User, true, nil
+}
+
+func (s *Storage) Sessions(userID string) ([]pp.Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	out := make([]pp.Session, 0)
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.ExpiresAt.After(now) {
+			out = append(out, session)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+
+	return out, nil
+}
+
+func (s *Storage) DeleteSession(userID, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if session, ok := s.sessions[sessionID]; ok && session.UserID == userID {
+		delete(s.sessions, sessionID)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteSessionByCookie(cookie string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, pp.SessionID(cookie))
+	return nil
+}
+
+func (s *Storage) DeleteUserSessions(userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) SetRole(userID, role string) error {
+	if role != pp.RoleUser && role != pp.RoleAdmin {
+		return fmt.Errorf("invalid role %q", role)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	u.Role = role
+	return nil
+}
+
+func (s *Storage) SuspendUser(userID, reason string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	u.Suspended, u.SuspendedReason = true, reason
+	return nil
+}
+
+func (s *Storage) UnsuspendUser(userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	u.Suspended, u.SuspendedReason = false, ""
+	return nil
+}
+
+// lastRequest returns the time of the latest request with the secret in log.
+func lastRequest(log []LogEntry, secret string) time.Time {
+	var last time.Time
+	for _, e := range log {
+		if e.Secret == secret && e.Timestamp.After(last) {
+			last = e.Timestamp
+		}
+	}
+	return last
+}
+
+func (s *Storage) Users() ([]pp.UserStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]pp.UserStatus, 0, len(s.users))
+	for _, u := range s.users {
+		out = append(out, pp.UserStatus{
+			User:            u.User,
+			SecretCreatedAt: u.secretCreatedAt,
+			LastFeed:        lastRequest(s.feedLog, u.secret),
+			LastPodcast:     lastRequest(s.podcastLog, u.secret),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out, nil
+}
+
+func (s *Storage) EpisodeStats() ([]pp.EpisodeStats, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	type episode struct{ channel, key string }
+	stats := make(map[episode]*pp.EpisodeStats)
+	secrets := make(map[episode]map[string]bool)
+	for _, e := range s.podcastLog {
+		k := episode{e.Channel, e.Key}
+		if stats[k] == nil {
+			stats[k] = &pp.EpisodeStats{Channel: e.Channel, Key: e.Key}
+			secrets[k] = make(map[string]bool)
+		}
+		stats[k].Requests++
+		secrets[k][e.Secret] = true
+		stats[k].Users = int64(len(secrets[k]))
+		if e.Timestamp.After(stats[k].LastRequest) {
+			stats[k].LastRequest = e.Timestamp
+		}
+	}
+
+	out := make([]pp.EpisodeStats, 0, len(stats))
+	for _, e := range stats {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Channel != out[j].Channel {
+			return out[i].Channel < out[j].Channel
+		}
+		return out[i].Key < out[j].Key
+	})
+
+	return out, nil
+}
+
+// secretOwner returns the ID of the user that owns or owned the secret, it
+// must be called with the mutex locked.
+func (s *Storage) secretOwner(secret string) string {
+	if u, ok := s.userBySecret(secret); ok {
+		return u.ID
+	}
+	for _, e := range s.history {
+		if e.Secret == secret {
+			return e.UserID
+		}
+	}
+	return ""
+}
+
+func (s *Storage) FeedClients() ([]pp.FeedClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	type client struct{ userID, channel, userAgent, referer string }
+	clients := make(map[client]*pp.FeedClient)
+	for _, e := range s.feedLog {
+		k := client{s.secretOwner(e.Secret), e.Channel, e.UserAgent, e.Referer}
+		if clients[k] == nil {
+			clients[k] = &pp.FeedClient{UserID: k.userID, Channel: k.channel, UserAgent: k.userAgent, Referer: k.referer}
+		}
+		clients[k].Requests++
+		if e.Timestamp.After(clients[k].LastSeen) {
+			clients[k].LastSeen = e.Timestamp
+		}
+	}
+
+	out := make([]pp.FeedClient, 0, len(clients))
+	for _, c := range clients {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].UserID != out[j].UserID {
+			return out[i].UserID < out[j].UserID
+		}
+		if out[i].Channel != out[j].Channel {
+			return out[i].Channel < out[j].Channel
+		}
+		return out[i].LastSeen.After(out[j].LastSeen)
+	})
+
+	return out, nil
+}
+
+func (s *Storage) RotateSecret(userID, reason string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	s.history = append(s.history, pp.SecretEvent{
+		UserID:    userID,
+		Secret:    u.secret,
+		CreatedAt: u.secretCreatedAt,
+		RevokedAt: now,
+		Reason:    reason,
+	})
+	u.secret, u.secretCreatedAt = pp.GenerateSecret(), now
+
+	return u.secret, nil
+}
+
+func (s *Storage) RevokeSecret(secret, reason string) error {
+	s.mutex.Lock()
+	u, ok := s.userBySecret(secret)
+	revoked := !ok && s.secretOwner(secret) != ""
+	s.mutex.Unlock()
+
+	if revoked {
+		// revoking an already revoked secret is fine, it's still revoked
+		return nil
+	}
+	if !ok {
+		return errors.New("no such secret")
+	}
+
+	_, err := s.RotateSecret(u.ID, reason)
+	return err
+}
+
+func (s *Storage) SecretHistory(userID string) ([]pp.SecretEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]pp.SecretEvent, 0)
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].UserID == userID {
+			out = append(out, s.history[i])
+		}
+	}
+
+	return out, nil
+}
+
+func (s *Storage) AddAccessRule(rule string) error {
+	rule, err := pp.NormalizeAccessRule(rule)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rules[rule] = true
+	return nil
+}
+
+func (s *Storage) RemoveAccessRule(rule string) error {
+	rule, err := pp.NormalizeAccessRule(rule)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.rules, rule)
+	return nil
+}
+
+func (s *Storage) AccessRules() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]string, 0, len(s.rules))
+	for rule := range s.rules {
+		out = append(out, rule)
+	}
+	sort.Strings(out)
+
+	return out, nil
+}
+
+func (s *Storage) UserAllowed(userID, hostedDomain string) (bool, error) {
+	rules, err := s.AccessRules()
+	if err != nil {
+		return false, err
+	}
+
+	for _, rule := range rules {
+		if pp.MatchAccessRule(rule, userID, hostedDomain) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Storage) GrantChannel(userID, channel string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.channels[userID] == nil {
+		s.channels[userID] = make(map[string]bool)
+	}
+	s.channels[userID][channel] = true
+	return nil
+}
+
+func (s *Storage) RevokeChannel(userID, channel string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.channels[userID], channel)
+	return nil
+}
+
+func (s *Storage) UserChannels(userID string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]string, 0)
+	for channel := range s.channels[userID] {
+		out = append(out, channel)
+	}
+	sort.Strings(out)
+
+	return out, nil
+}
+
+func (s *Storage) SecretActivity(since time.Time) ([]pp.SecretActivity, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	activity := make(map[string]*pp.SecretActivity)
+	userAgents := make(map[string]map[string]bool)
+	clientIPs := make(map[string]map[string]bool)
+
+	count := func(e LogEntry, podcast bool) {
+		u, ok := s.userBySecret(e.Secret)
+		if !ok || u.Suspended || e.Timestamp.Before(since) {
+			return
+		}
+
+		a := activity[e.Secret]
+		if a == nil {
+			a = &pp.SecretActivity{UserID: u.ID, Secret: e.Secret}
+			activity[e.Secret] = a
+			userAgents[e.Secret] = make(map[string]bool)
+			clientIPs[e.Secret] = make(map[string]bool)
+		}
+
+		if podcast {
+			a.PodcastRequests++
+		} else {
+			a.FeedRequests++
+		}
+		userAgents[e.Secret][e.UserAgent] = true
+		if e.ClientIP != "" {
+			clientIPs[e.Secret][e.ClientIP] = true
+		}
+		a.UserAgents = int64(len(userAgents[e.Secret]))
+		a.ClientIPs = int64(len(clientIPs[e.Secret]))
+	}
+	for _, e := range s.feedLog {
+		count(e, false)
+	}
+	for _, e := range s.podcastLog {
+		count(e, true)
+	}
+
+	out := make([]pp.SecretActivity, 0, len(activity))
+	for _, a := range activity {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UserID < out[j].UserID })
+
+	return out, nil
+}
+
+func (s *Storage) LogFeed(secret, channel, referer, userAgent, clientIP string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.feedLog = append(s.feedLog, LogEntry{secret, channel, "", referer, userAgent, clientIP, time.Now()})
+	return nil
+}
+
+func (s *Storage) LogPodcast(secret, channel, key, referer, userAgent, clientIP string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.podcastLog = append(s.podcastLog, LogEntry{secret, channel, key, referer, userAgent, clientIP, time.Now()})
+	return nil
+}
@@ -0,0 +1,192 @@
+package pp
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sidecarSuffixes are the suffixes of the sidecar file of a podcast, the key of
+// the sidecar is the key of the podcast with the suffix. JSON is valid YAML, so
+// the same parser is used for all of them.
+var sidecarSuffixes = []string{".json", ".yaml", ".yml"}
+
+// sidecarKey returns the key of the sidecar of the podcast with the given key,
+// exists is used to check which of the possible sidecars exists. The key is
+// empty if the podcast has no sidecar.
+func sidecarKey(key string, exists func(string) bool) string {
+	for _, suffix := range sidecarSuffixes {
+		if exists(key + suffix) {
+			return key + suffix
+		}
+	}
+	return ""
+}
+
+// isSidecar returns true if the key is the sidecar of a podcast (which might
+// not exist).
+func isSidecar(key string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(key, suffix) && isEpisode(strings.TrimSuffix(key, suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecar is the metadata of a podcast in the sidecar file next to it, every
+// field that is set overrides the details derived from the key of the podcast
+// and its description file.
+type sidecar struct {
+	Title       *string `yaml:"title"`
+	Description *string `yaml:"description"`
+	// Published is either RFC 3339 (2020-01-27T09:00:00+02:00) or a date and
+	// time (2020-01-27 09:00) in Timezone
+	Published string `yaml:"published"`
+	// Expires is when the episode is taken down, in the same format as Published
+	Expires string `yaml:"expires"`
+	// Timezone is the name of a timezone, e.g. Europe/Helsinki, by default
+	// the timezone of the channel
+	Timezone string `yaml:"timezone"`
+	Episode  int    `yaml:"episode"`
+	Season   int    `yaml:"season"`
+	Explicit *bool  `yaml:"explicit"`
+	// Duration is either seconds, [HH:]MM:SS or a Go duration (1h2m3s)
+	Duration string `yaml:"duration"`
+	Artwork  string `yaml:"artwork"`
+	GUID     string `yaml:"guid"`
+}
+
+// publishedLayouts are the layouts of Published without a timezone.
+var publishedLayouts = []string{"2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"}
+
+// parsePublished parses the published (or expires) time of a sidecar, loc is
+// the timezone if neither the time nor the sidecar has one.
+func parsePublished(published, timezone string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, published); err == nil {
+		if timezone != "" {
+			return t, fmt.Errorf("published %q already has a timezone, timezone can't be set", published)
+		}
+		return t, nil
+	}
+
+	if timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+	}
+
+	for _, layout := range publishedLayouts {
+		if t, err := time.ParseInLocation(layout, published, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid published %q (expected RFC 3339 or YYYY-MM-DD HH:MM)", published)
+}
+
+// parseDuration parses the duration of a sidecar.
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 || len(parts) == 3 {
+		var d time.Duration
+		for _, part := range parts {
+			n, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			d = d*60 + time.Duration(n)
+		}
+		return d * time.Second, nil
+	}
+
+	return 0, fmt.Errorf("invalid duration %q (expected seconds, [HH:]MM:SS or 1h2m3s)", s)
+}
+
+// IsArtworkURL returns true if the artwork of an episode is an absolute URL,
+// otherwise it's the key of an image in the backend.
+func IsArtworkURL(artwork string) bool {
+	u, err := url.Parse(artwork)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// applySidecar parses the sidecar file and applies it to the details, unknown
+// fields are an error so that typos don't go unnoticed. loc is the timezone of
+// the times that don't have one, unless the sidecar sets its own. A panic of
+// the parser is an error too, the sidecar comes from the backend and must not
+// be able to crash the process.
+func applySidecar(details PodcastDetails, data []byte, loc *time.Location) (out PodcastDetails, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = details, fmt.Errorf("failed to parse the sidecar of %q: %v", details.Key, r)
+		}
+	}()
+
+	var s sidecar
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&s)
+	if err != nil {
+		return details, fmt.Errorf("failed to parse the sidecar of %q: %v", details.Key, err)
+	}
+
+	if s.Title != nil {
+		details.Title = *s.Title
+	}
+	if s.Description != nil {
+		details.Description = *s.Description
+	}
+	if s.Published != "" {
+		details.Published, err = parsePublished(s.Published, s.Timezone, loc)
+		if err != nil {
+			return details, fmt.Errorf("invalid sidecar of %q: %v", details.Key, err)
+		}
+	}
+	if s.Expires != "" {
+		details.Expires, err = parsePublished(s.Expires, s.Timezone, loc)
+		if err != nil {
+			return details, fmt.Errorf("invalid sidecar of %q: %v", details.Key, err)
+		}
+		if !details.Expires.After(details.Published) {
+			return details, fmt.Errorf("invalid sidecar of %q: expires %v is not after published %v", details.Key, details.Expires, details.Published)
+		}
+	}
+	if s.Published == "" && s.Expires == "" && s.Timezone != "" {
+		return details, fmt.Errorf("invalid sidecar of %q: timezone is only used with published and expires", details.Key)
+	}
+	if s.Episode < 0 || s.Season < 0 {
+		return details, fmt.Errorf("invalid sidecar of %q: episode and season must not be negative", details.Key)
+	}
+	details.Episode = s.Episode
+	details.Season = s.Season
+	if s.Explicit != nil {
+		details.Explicit = *s.Explicit
+	}
+	if s.Duration != "" {
+		details.Duration, err = parseDuration(s.Duration)
+		if err != nil {
+			return details, fmt.Errorf("invalid sidecar of %q: %v", details.Key, err)
+		}
+	}
+	if strings.Contains(s.Artwork, "://") && !IsArtworkURL(s.Artwork) {
+		return details, fmt.Errorf("invalid sidecar of %q: artwork %q must be a key or a HTTP(S) URL", details.Key, s.Artwork)
+	}
+	details.Artwork = s.Artwork
+	details.GUID = s.GUID
+
+	return details, nil
+}
@@ -2,16 +2,151 @@ package pp
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"log"
+	"fmt"
+	"time"
 )
 
+// RoleAdmin is the role of the users that can access the admin pages, other users have RoleUser.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type User struct {
+	ID           string
+	HostedDomain string
+	Role         string
+	// Suspended users can't log in or use their secret until they are unsuspended.
+	Suspended       bool
+	SuspendedReason string
+	CreatedAt       time.Time
+}
+
+// UserStatus is a user along with when their current secret was last used.
+type UserStatus struct {
+	User
+	SecretCreatedAt time.Time
+	// LastFeed and LastPodcast are zero if the secret has not been used.
+	LastFeed    time.Time
+	LastPodcast time.Time
+}
+
+// EpisodeStats are the statistics of the requests made to a single episode.
+type EpisodeStats struct {
+	Channel     string
+	Key         string
+	Requests    int64
+	Users       int64
+	LastRequest time.Time
+}
+
+// FeedClient is a distinct client (user agent and referer) that has requested
+// the feed of a channel with the secret of a user.
+type FeedClient struct {
+	UserID    string
+	Channel   string
+	UserAgent string
+	Referer   string
+	Requests  int64
+	LastSeen  time.Time
+}
+
+// SecretEvent is an entry in the history of the secrets of a user, every entry
+// is a secret that has been revoked.
+type SecretEvent struct {
+	UserID    string
+	Secret    string
+	CreatedAt time.Time
+	RevokedAt time.Time
+	Reason    string
+}
+
+// Session is a logged in session of a user, the ID is not the value of the
+// session cookie but a hash of it, so it can be shown to the user.
+type Session struct {
+	ID        string
+	UserID    string
+	UserAgent string
+	ClientIP  string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+}
+
 type Storage interface {
 	Init() error
-	CreateUser(userID string) (string, error)
-	ValidSecret(secret string) (bool, error)
-	LogFeed(secret, referer, userAgent string) error
-	LogPodcast(secret, key, referer, userAgent string) error
+	// CreateUser creates the user if it doesn't exist yet and returns the secret
+	// of the user, the hosted domain of an existing user is updated.
+	CreateUser(userID, hostedDomain string) (string, error)
+	// UserBySecret returns the user that owns the secret, the returned bool is
+	// false if the secret is not valid.
+	UserBySecret(secret string) (User, bool, error)
+	// UserSecret returns the current secret of the user.
+	UserSecret(userID string) (string, error)
+
+	// CreateSession creates a new session for the user and returns the value of
+	// the session cookie, the session expires at expiresAt at the latest.
+	CreateSession(userID, userAgent, clientIP string, expiresAt time.Time) (string, error)
+	// SessionUser returns the user of the session cookie and marks the session as
+	// used, the returned bool is false if the session doesn't exist, has expired
+	// or hasn't been used for longer than idleTimeout.
+	SessionUser(cookie string, idleTimeout time.Duration) (User, bool, error)
+	// Sessions returns the sessions of the user that haven't expired, latest first.
+	Sessions(userID string) ([]Session, error)
+	// DeleteSession deletes the session with the given ID (see Session) of the user.
+	DeleteSession(userID, sessionID string) error
+	// DeleteSessionByCookie deletes the session of the session cookie.
+	DeleteSessionByCookie(cookie string) error
+	// DeleteUserSessions deletes all sessions of the user.
+	DeleteUserSessions(userID string) error
+
+	// SetRole sets the role of the user, see RoleUser and RoleAdmin.
+	SetRole(userID, role string) error
+	SuspendUser(userID, reason string) error
+	UnsuspendUser(userID string) error
+
+	// Users returns all users ordered by their ID.
+	Users() ([]UserStatus, error)
+	EpisodeStats() ([]EpisodeStats, error)
+	FeedClients() ([]FeedClient, error)
+
+	// RotateSecret replaces the secret of the user with a new one and returns it,
+	// the old secret is revoked with the given reason.
+	RotateSecret(userID, reason string) (string, error)
+	// RevokeSecret revokes the secret, the user that owns it gets a new secret
+	// which they'll see the next time they log in.
+	RevokeSecret(secret, reason string) error
+	// SecretHistory returns the revoked secrets of the user, latest first.
+	SecretHistory(userID string) ([]SecretEvent, error)
+
+	// AddAccessRule adds the rule to the allowlist, see NormalizeAccessRule for the
+	// format of the rules.
+	AddAccessRule(rule string) error
+	RemoveAccessRule(rule string) error
+	AccessRules() ([]string, error)
+	// UserAllowed returns true if any of the access rules matches the user.
+	UserAllowed(userID, hostedDomain string) (bool, error)
+
+	// GrantChannel gives the user access to a restricted channel.
+	GrantChannel(userID, channel string) error
+	RevokeChannel(userID, channel string) error
+	// UserChannels returns the restricted channels the user has been granted access to.
+	UserChannels(userID string) ([]string, error)
+
+	// SecretActivity returns the activity of every current secret (of users that
+	// aren't suspended) since the given time, secrets without activity are left out.
+	SecretActivity(since time.Time) ([]SecretActivity, error)
+
+	LogFeed(secret, channel, referer, userAgent, clientIP string) error
+	LogPodcast(secret, channel, key, referer, userAgent, clientIP string) error
+}
+
+// Pinger is implemented by the storages that connect to a database, Ping
+// checks that the database can be reached.
+type Pinger interface {
+	Ping() error
 }
 
 // SecretSizeBytes is the size of the secret in bytes, it should be a multiple of 12 to make sure it's encoded nicely in base64.
@@ -22,8 +157,15 @@ func GenerateSecret() string {
 	v := make([]byte, SecretSizeBytes)
 	n, err := rand.Read(v)
 	if err != nil || n != SecretSizeBytes {
-		log.Panicf("failed to create random %v bytes: %v", SecretSizeBytes, err)
+		panic(fmt.Sprintf("failed to create random %v bytes: %v", SecretSizeBytes, err))
 	}
 
 	return base64.URLEncoding.EncodeToString(v)
 }
+
+// SessionID returns the ID of the session with the given cookie, only the ID
+// is stored so that the cookies can't be recovered from the storage.
+func SessionID(cookie string) string {
+	hash := sha256.Sum256([]byte(cookie))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,673 @@
+package pp
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// storageSQL implements Storage on top of database/sql, the queries are
+// written for Postgres and rewritten for SQLite by rebind. It's embedded by
+// StoragePostgres and StorageSQLite.
+type storageSQL struct {
+	db *sql.DB
+	// sqlite is true if the database is SQLite instead of Postgres
+	sqlite bool
+	log    Logger
+}
+
+var dollarParam = regexp.MustCompile(`\$([0-9]+)`)
+
+// rebind rewrites the query written for Postgres for the database: SQLite
+// numbers its parameters as ?N instead of $N and doesn't know IF (NOT) EXISTS
+// for columns.
+func (s storageSQL) rebind(query string) string {
+	if !s.sqlite {
+		return query
+	}
+
+	query = dollarParam.ReplaceAllString(query, "?$1")
+	query = strings.Replace(query, "ADD COLUMN IF NOT EXISTS", "ADD COLUMN", -1)
+	query = strings.Replace(query, "DROP COLUMN IF EXISTS", "DROP COLUMN", -1)
+	return query
+}
+
+// lockRow returns what is appended to the selects that must lock the selected
+// row until the end of the transaction, SQLite has a single writer anyway.
+func (s storageSQL) lockRow() string {
+	if s.sqlite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+func (s storageSQL) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s storageSQL) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s storageSQL) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// sqlTimeLayouts are the layouts of the timestamps that are returned as text,
+// SQLite does that for the timestamps computed by a query (e.g. MAX).
+var sqlTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// sqlTime is a nullable timestamp that can be scanned from a timestamp or its
+// text representation, NULL is scanned as the zero time.
+type sqlTime time.Time
+
+func (t *sqlTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*t = sqlTime{}
+		return nil
+	case time.Time:
+		*t = sqlTime(v)
+		return nil
+	case []byte:
+		value = string(v)
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("can't scan %T into a timestamp", value)
+	}
+	for _, layout := range sqlTimeLayouts {
+		parsed, err := time.ParseInLocation(layout, text, time.UTC)
+		if err == nil {
+			*t = sqlTime(parsed)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamp %q", text)
+}
+
+// Init applies the migrations that haven't been applied yet.
+func (s storageSQL) Init() error {
+	return s.MigrateUp()
+}
+
+func (s storageSQL) Ping() error {
+	return s.db.Ping()
+}
+
+func (s storageSQL) CreateUser(userID, hostedDomain string) (string, error) {
+	var secret string
+
+	// if a user with the given userID already exists return that users secret
+	// instead, this makes sure the user can access the home page even if their
+	// cookies are reseted (or if they use multiple machines)
+	err := s.queryRow(
+		`UPDATE users SET hosted_domain = $2 WHERE user_id = $1 RETURNING secret`,
+		userID, hostedDomain).Scan(&secret)
+	if err == nil {
+		return secret, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to update user in db: %v", err)
+	}
+
+	secret = GenerateSecret()
+
+	_, err = s.exec(
+		`INSERT INTO users (user_id, secret, hosted_domain, secret_created_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)`,
+		userID, secret, hostedDomain)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert user into db: %v", err)
+	}
+
+	return secret, nil
+}
+
+func (s storageSQL) UserBySecret(secret string) (User, bool, error) {
+	var (
+		user            User
+		suspendedReason sql.NullString
+	)
+
+	err := s.queryRow(
+		`SELECT user_id, hosted_domain, role, suspended_reason, created_at FROM users WHERE secret = $1`,
+		secret).Scan(&user.ID, &user.HostedDomain, &user.Role, &suspendedReason, &user.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.log.Debug("invalid secret", "secret", secret)
+			return User{}, false, nil
+		}
+		return User{}, false, err
+	}
+
+	user.Suspended, user.SuspendedReason = suspendedReason.Valid, suspendedReason.String
+
+	s.log.Debug("fetched the user of a secret from the db", "user", user.ID)
+	return user, true, nil
+}
+
+func (s storageSQL) UserSecret(userID string) (string, error) {
+	var secret string
+
+	err := s.queryRow(`SELECT secret FROM users WHERE user_id = $1`, userID).Scan(&secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("user %q does not exist", userID)
+		}
+		return "", fmt.Errorf("failed to query db: %v", err)
+	}
+
+	return secret, nil
+}
+
+func (s storageSQL) CreateSession(userID, userAgent, clientIP string, expiresAt time.Time) (string, error) {
+	now := time.Now().UTC()
+
+	// this is as good of a place as any to get rid of the expired sessions
+	_, err := s.exec(`DELETE FROM sessions WHERE expires_at < $1`, now)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete from db: %v", err)
+	}
+
+	cookie := GenerateSecret()
+	_, err = s.exec(
+		`INSERT INTO sessions (session_id, user_id, user_agent, client_ip, created_at, last_seen, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $5, $6)`,
+		SessionID(cookie), userID, userAgent, clientIP, now, expiresAt.UTC())
+	if err != nil {
+		return "", fmt.Errorf("failed to insert into db: %v", err)
+	}
+
+	return cookie, nil
+}
+
+func (s storageSQL) SessionUser(cookie string, idleTimeout time.Duration) (User, bool, error) {
+	sessionID := SessionID(cookie)
+	now := time.Now().UTC()
+
+	var secret string
+	err := s.queryRow(
+		`SELECT u.secret FROM sessions s JOIN users u ON u.user_id = s.user_id
+		WHERE s.session_id = $1 AND s.expires_at > $2 AND s.last_seen > $3`,
+		sessionID, now, now.Add(-idleTimeout)).Scan(&secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, false, nil
+		}
+		return User{}, false, fmt.Errorf("failed to query db: %v", err)
+	}
+
+	_, err = s.exec(`UPDATE sessions SET last_seen = $2 WHERE session_id = $1`, sessionID, now)
+	if err != nil {
+		return User{}, false, fmt.Errorf("failed to update session in db: %v", err)
+	}
+
+	return s.UserBySecret(secret)
+}
+
+func (s storageSQL) Sessions(userID string) ([]Session, error) {
+	rows, err := s.query(
+		`SELECT session_id, user_id, user_agent, client_ip, created_at, last_seen, expires_at
+		FROM sessions WHERE user_id = $1 AND expires_at > $2 ORDER BY last_seen DESC`,
+		userID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]Session, 0)
+	for rows.Next() {
+		var e Session
+		err := rows.Scan(&e.ID, &e.UserID, &e.UserAgent, &e.ClientIP, &e.CreatedAt, &e.LastSeen, &e.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) DeleteSession(userID, sessionID string) error {
+	_, err := s.exec(`DELETE FROM sessions WHERE user_id = $1 AND session_id = $2`, userID, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete from db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) DeleteSessionByCookie(cookie string) error {
+	_, err := s.exec(`DELETE FROM sessions WHERE session_id = $1`, SessionID(cookie))
+	if err != nil {
+		return fmt.Errorf("failed to delete from db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) DeleteUserSessions(userID string) error {
+	_, err := s.exec(`DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete from db: %v", err)
+	}
+
+	return nil
+}
+
+// execUser executes a query that updates a single user, the first argument of
+// the query must be the ID of the user.
+func (s storageSQL) execUser(query string, userID string, args ...interface{}) error {
+	res, err := s.exec(query, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to update user in db: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user %q does not exist", userID)
+	}
+
+	return nil
+}
+
+func (s storageSQL) SetRole(userID, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return fmt.Errorf("invalid role %q", role)
+	}
+
+	return s.execUser(`UPDATE users SET role = $2 WHERE user_id = $1`, userID, role)
+}
+
+func (s storageSQL) SuspendUser(userID, reason string) error {
+	return s.execUser(`UPDATE users SET suspended_reason = $2 WHERE user_id = $1`, userID, reason)
+}
+
+func (s storageSQL) UnsuspendUser(userID string) error {
+	return s.execUser(`UPDATE users SET suspended_reason = NULL WHERE user_id = $1`, userID)
+}
+
+func (s storageSQL) Users() ([]UserStatus, error) {
+	rows, err := s.query(
+		`SELECT u.user_id, u.hosted_domain, u.role, u.suspended_reason, u.created_at, u.secret_created_at,
+			(SELECT MAX(f.timestamp) FROM log_feed f WHERE f.secret = u.secret),
+			(SELECT MAX(p.timestamp) FROM log_podcast p WHERE p.secret = u.secret)
+		FROM users u ORDER BY u.user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]UserStatus, 0)
+	for rows.Next() {
+		var (
+			u                     UserStatus
+			suspendedReason       sql.NullString
+			lastFeed, lastPodcast sqlTime
+		)
+		err := rows.Scan(
+			&u.ID, &u.HostedDomain, &u.Role, &suspendedReason, &u.CreatedAt, &u.SecretCreatedAt,
+			&lastFeed, &lastPodcast)
+		if err != nil {
+			return nil, err
+		}
+		u.Suspended, u.SuspendedReason = suspendedReason.Valid, suspendedReason.String
+		u.LastFeed, u.LastPodcast = time.Time(lastFeed), time.Time(lastPodcast)
+		out = append(out, u)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) EpisodeStats() ([]EpisodeStats, error) {
+	rows, err := s.query(
+		`SELECT channel, key, COUNT(*), COUNT(DISTINCT secret), MAX(timestamp)
+		FROM log_podcast GROUP BY channel, key ORDER BY channel, key`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]EpisodeStats, 0)
+	for rows.Next() {
+		var e EpisodeStats
+		if err := rows.Scan(&e.Channel, &e.Key, &e.Requests, &e.Users, (*sqlTime)(&e.LastRequest)); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) FeedClients() ([]FeedClient, error) {
+	// the secret may have been revoked since, in which case the user is found
+	// from the history of secrets instead
+	rows, err := s.query(
+		`SELECT COALESCE(u.user_id, h.user_id, ''), f.channel, f.user_agent, f.referer, COUNT(*), MAX(f.timestamp)
+		FROM log_feed f
+		LEFT JOIN users u ON u.secret = f.secret
+		LEFT JOIN secret_history h ON h.secret = f.secret
+		GROUP BY 1, 2, 3, 4
+		ORDER BY 1, 2, 6 DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]FeedClient, 0)
+	for rows.Next() {
+		var c FeedClient
+		if err := rows.Scan(&c.UserID, &c.Channel, &c.UserAgent, &c.Referer, &c.Requests, (*sqlTime)(&c.LastSeen)); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+
+	return out, rows.Err()
+}
+
+// replaceSecret moves the secret of the user to the history and gives the user
+// a new one in tx. The update is keyed by the old secret so that a secret that
+// was replaced concurrently isn't replaced again.
+func (s storageSQL) replaceSecret(tx *sql.Tx, userID, oldSecret string, oldSecretCreated time.Time, reason string) (string, error) {
+	_, err := tx.Exec(
+		s.rebind(`INSERT INTO secret_history (user_id, secret, created_at, reason) VALUES ($1, $2, $3, $4)`),
+		userID, oldSecret, oldSecretCreated, reason)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert into db: %v", err)
+	}
+
+	secret := GenerateSecret()
+	res, err := tx.Exec(
+		s.rebind(`UPDATE users SET secret = $2, secret_created_at = CURRENT_TIMESTAMP WHERE secret = $1`),
+		oldSecret, secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to update user in db: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("failed to update user in db: %v", err)
+	}
+	if n != 1 {
+		return "", errors.New("the secret was replaced concurrently, try again")
+	}
+
+	return secret, nil
+}
+
+func (s storageSQL) RotateSecret(userID, reason string) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		oldSecret        string
+		oldSecretCreated time.Time
+	)
+	err = tx.QueryRow(
+		s.rebind(`SELECT secret, secret_created_at FROM users WHERE user_id = $1`+s.lockRow()),
+		userID).Scan(&oldSecret, &oldSecretCreated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("user %q does not exist", userID)
+		}
+		return "", fmt.Errorf("failed to query db: %v", err)
+	}
+
+	secret, err := s.replaceSecret(tx, userID, oldSecret, oldSecretCreated, reason)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	s.log.Info("rotated the secret of a user", "user", userID, "reason", reason)
+	return secret, nil
+}
+
+// RevokeSecret looks up the owner and replaces the secret in the same
+// transaction, so that it never replaces a secret the user got in between.
+func (s storageSQL) RevokeSecret(secret, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID        string
+		secretCreated time.Time
+	)
+	err = tx.QueryRow(
+		s.rebind(`SELECT user_id, secret_created_at FROM users WHERE secret = $1`+s.lockRow()),
+		secret).Scan(&userID, &secretCreated)
+	if err == sql.ErrNoRows {
+		// revoking an already revoked secret is fine, it's still revoked
+		err = tx.QueryRow(s.rebind(`SELECT user_id FROM secret_history WHERE secret = $1`), secret).Scan(&userID)
+		if err == nil {
+			return nil
+		}
+		if err == sql.ErrNoRows {
+			return errors.New("no such secret")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query db: %v", err)
+	}
+
+	_, err = s.replaceSecret(tx, userID, secret, secretCreated, reason)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	s.log.Info("revoked the secret of a user", "user", userID, "reason", reason)
+	return nil
+}
+
+func (s storageSQL) SecretHistory(userID string) ([]SecretEvent, error) {
+	rows, err := s.query(
+		`SELECT user_id, secret, created_at, revoked_at, reason FROM secret_history
+		WHERE user_id = $1 ORDER BY revoked_at DESC`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]SecretEvent, 0)
+	for rows.Next() {
+		var e SecretEvent
+		if err := rows.Scan(&e.UserID, &e.Secret, &e.CreatedAt, &e.RevokedAt, &e.Reason); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) AddAccessRule(rule string) error {
+	rule, err := NormalizeAccessRule(rule)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(`INSERT INTO access_rules (rule) VALUES ($1) ON CONFLICT (rule) DO NOTHING`, rule)
+	if err != nil {
+		return fmt.Errorf("failed to insert into db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) RemoveAccessRule(rule string) error {
+	rule, err := NormalizeAccessRule(rule)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(`DELETE FROM access_rules WHERE rule = $1`, rule)
+	if err != nil {
+		return fmt.Errorf("failed to delete from db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) AccessRules() ([]string, error) {
+	rows, err := s.query(`SELECT rule FROM access_rules ORDER BY rule`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var rule string
+		if err := rows.Scan(&rule); err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) UserAllowed(userID, hostedDomain string) (bool, error) {
+	rules, err := s.AccessRules()
+	if err != nil {
+		return false, err
+	}
+
+	for _, rule := range rules {
+		if MatchAccessRule(rule, userID, hostedDomain) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s storageSQL) GrantChannel(userID, channel string) error {
+	_, err := s.exec(
+		`INSERT INTO channel_access (user_id, channel) VALUES ($1, $2)
+		ON CONFLICT (user_id, channel) DO NOTHING`,
+		userID, channel)
+	if err != nil {
+		return fmt.Errorf("failed to insert into db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) RevokeChannel(userID, channel string) error {
+	_, err := s.exec(`DELETE FROM channel_access WHERE user_id = $1 AND channel = $2`, userID, channel)
+	if err != nil {
+		return fmt.Errorf("failed to delete from db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) UserChannels(userID string) ([]string, error) {
+	rows, err := s.query(`SELECT channel FROM channel_access WHERE user_id = $1 ORDER BY channel`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var channel string
+		if err := rows.Scan(&channel); err != nil {
+			return nil, err
+		}
+		out = append(out, channel)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) SecretActivity(since time.Time) ([]SecretActivity, error) {
+	// rows logged before client IPs were logged have an empty client IP, they
+	// are not counted as a distinct IP
+	rows, err := s.query(
+		`SELECT u.user_id, l.secret,
+			COUNT(DISTINCT l.user_agent),
+			COUNT(DISTINCT NULLIF(l.client_ip, '')),
+			SUM(1 - l.podcast),
+			SUM(l.podcast)
+		FROM (
+			SELECT secret, user_agent, client_ip, 0 AS podcast FROM log_feed WHERE timestamp >= $1
+			UNION ALL
+			SELECT secret, user_agent, client_ip, 1 AS podcast FROM log_podcast WHERE timestamp >= $1
+		) l
+		JOIN users u ON u.secret = l.secret
+		WHERE u.suspended_reason IS NULL
+		GROUP BY u.user_id, l.secret
+		ORDER BY u.user_id`,
+		since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]SecretActivity, 0)
+	for rows.Next() {
+		var a SecretActivity
+		err := rows.Scan(&a.UserID, &a.Secret, &a.UserAgents, &a.ClientIPs, &a.FeedRequests, &a.PodcastRequests)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+func (s storageSQL) LogFeed(secret, channel, referer, userAgent, clientIP string) error {
+	_, err := s.exec(
+		`INSERT INTO log_feed (secret, channel, referer, user_agent, client_ip)
+		VALUES ($1, $2, $3, $4, $5)`,
+		secret, channel, referer, userAgent, clientIP)
+	if err != nil {
+		return fmt.Errorf("failed to insert into db: %v", err)
+	}
+
+	return nil
+}
+
+func (s storageSQL) LogPodcast(secret, channel, key, referer, userAgent, clientIP string) error {
+	_, err := s.exec(
+		`INSERT INTO log_podcast (secret, channel, key, referer, user_agent, client_ip)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		secret, channel, key, referer, userAgent, clientIP)
+	if err != nil {
+		return fmt.Errorf("failed to insert into db: %v", err)
+	}
+
+	return nil
+}
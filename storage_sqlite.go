@@ -0,0 +1,39 @@
+package pp
+
+import (
+	"database/sql"
+	"strings"
+
+	// go-sqlite3 is used through database/sql by StorageSQLite
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// StorageSQLite stores everything in a single SQLite file, it has the same
+// schema as StoragePostgres and is meant for single node deployments.
+type StorageSQLite struct {
+	storageSQL
+}
+
+// NewStorageSQLite opens the database at path, which is either a file path or
+// a file: URI (see https://www.sqlite.org/uri.html).
+func NewStorageSQLite(path string, logger Logger) (StorageSQLite, error) {
+	// writers wait for each other instead of failing with "database is locked"
+	if !strings.Contains(path, "_busy_timeout") {
+		if strings.Contains(path, "?") {
+			path += "&_busy_timeout=5000"
+		} else {
+			path += "?_busy_timeout=5000"
+		}
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return StorageSQLite{}, err
+	}
+
+	// SQLite has a single writer anyway, a single connection also makes the
+	// transactions of RotateSecret safe without row locks
+	db.SetMaxOpenConns(1)
+
+	return StorageSQLite{storageSQL{db: db, sqlite: true, log: logger}}, nil
+}
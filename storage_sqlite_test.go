@@ -0,0 +1,206 @@
+package pp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/polarpayne/pp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLite(t *testing.T) (pp.StorageSQLite, func()) {
+	dir, err := ioutil.TempDir("", "pp-sqlite-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := pp.NewStorageSQLite(filepath.Join(dir, "pp.db"), pp.Logger{})
+	if err == nil {
+		err = s.Init()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestStorageSQLiteUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSQLite(t)
+	defer cleanup()
+
+	secret, err := s.CreateUser("alice@example.com", "example.com")
+	assert.NoError(err)
+
+	again, err := s.CreateUser("alice@example.com", "example.com")
+	assert.NoError(err)
+	assert.Equal(secret, again)
+
+	user, ok, err := s.UserBySecret(secret)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("alice@example.com", user.ID)
+	assert.Equal(pp.RoleUser, user.Role)
+	assert.False(user.Suspended)
+
+	assert.NoError(s.SuspendUser("alice@example.com", "testing"))
+	user, _, err = s.UserBySecret(secret)
+	assert.NoError(err)
+	assert.True(user.Suspended)
+	assert.Equal("testing", user.SuspendedReason)
+	assert.Error(s.SuspendUser("bob@example.com", "does not exist"))
+
+	rotated, err := s.RotateSecret("alice@example.com", "leaked")
+	assert.NoError(err)
+	assert.NotEqual(secret, rotated)
+
+	_, ok, err = s.UserBySecret(secret)
+	assert.NoError(err)
+	assert.False(ok)
+
+	// revoking a secret that is already revoked doesn't rotate again
+	assert.NoError(s.RevokeSecret(secret, "leaked again"))
+	current, err := s.UserSecret("alice@example.com")
+	assert.NoError(err)
+	assert.Equal(rotated, current)
+
+	history, err := s.SecretHistory("alice@example.com")
+	assert.NoError(err)
+	if assert.Len(history, 1) {
+		assert.Equal(secret, history[0].Secret)
+		assert.Equal("leaked", history[0].Reason)
+	}
+
+	// concurrent revocations of the current secret replace it only once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(s.RevokeSecret(rotated, "leaked"))
+		}()
+	}
+	wg.Wait()
+
+	history, err = s.SecretHistory("alice@example.com")
+	assert.NoError(err)
+	assert.Len(history, 2)
+	current, err = s.UserSecret("alice@example.com")
+	assert.NoError(err)
+	assert.NotEqual(rotated, current)
+	assert.Error(s.RevokeSecret("unknown", "leaked"))
+}
+
+func TestStorageSQLiteLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSQLite(t)
+	defer cleanup()
+
+	secret, err := s.CreateUser("alice@example.com", "")
+	assert.NoError(err)
+
+	assert.NoError(s.LogFeed(secret, "default", "", "Overcast", "10.0.0.1"))
+	assert.NoError(s.LogPodcast(secret, "default", "2020-01-27 Hello.mp3", "", "Overcast", "10.0.0.1"))
+	assert.NoError(s.LogPodcast(secret, "default", "2020-01-27 Hello.mp3", "", "VLC", "10.0.0.2"))
+
+	users, err := s.Users()
+	assert.NoError(err)
+	if assert.Len(users, 1) {
+		assert.False(users[0].LastFeed.IsZero())
+		assert.False(users[0].LastPodcast.IsZero())
+	}
+
+	episodes, err := s.EpisodeStats()
+	assert.NoError(err)
+	if assert.Len(episodes, 1) {
+		assert.Equal(int64(2), episodes[0].Requests)
+		assert.Equal(int64(1), episodes[0].Users)
+		assert.False(episodes[0].LastRequest.IsZero())
+	}
+
+	activity, err := s.SecretActivity(time.Now().Add(-time.Hour))
+	assert.NoError(err)
+	assert.Equal([]pp.SecretActivity{{
+		UserID:          "alice@example.com",
+		Secret:          secret,
+		UserAgents:      2,
+		ClientIPs:       2,
+		FeedRequests:    1,
+		PodcastRequests: 2,
+	}}, activity)
+}
+
+func TestStorageSQLiteChannels(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSQLite(t)
+	defer cleanup()
+
+	channels, err := s.UserChannels("alice@example.com")
+	assert.NoError(err)
+	assert.Empty(channels)
+
+	// granting twice is fine
+	assert.NoError(s.GrantChannel("alice@example.com", "members"))
+	assert.NoError(s.GrantChannel("alice@example.com", "members"))
+	assert.NoError(s.GrantChannel("alice@example.com", "bonus"))
+	assert.NoError(s.GrantChannel("bob@example.com", "members"))
+
+	channels, err = s.UserChannels("alice@example.com")
+	assert.NoError(err)
+	assert.Equal([]string{"bonus", "members"}, channels)
+
+	assert.NoError(s.RevokeChannel("alice@example.com", "members"))
+	assert.NoError(s.RevokeChannel("alice@example.com", "not granted"))
+	channels, err = s.UserChannels("alice@example.com")
+	assert.NoError(err)
+	assert.Equal([]string{"bonus"}, channels)
+
+	// the grants of other users are left alone
+	channels, err = s.UserChannels("bob@example.com")
+	assert.NoError(err)
+	assert.Equal([]string{"members"}, channels)
+}
+
+func TestStorageSQLiteSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSQLite(t)
+	defer cleanup()
+
+	_, err := s.CreateUser("alice@example.com", "")
+	assert.NoError(err)
+
+	cookie, err := s.CreateSession("alice@example.com", "Firefox", "10.0.0.1", time.Now().Add(time.Hour))
+	assert.NoError(err)
+
+	user, ok, err := s.SessionUser(cookie, time.Hour)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("alice@example.com", user.ID)
+
+	// the session is not used for longer than the idle timeout
+	_, ok, err = s.SessionUser(cookie, -time.Second)
+	assert.NoError(err)
+	assert.False(ok)
+
+	sessions, err := s.Sessions("alice@example.com")
+	assert.NoError(err)
+	if assert.Len(sessions, 1) {
+		assert.Equal(pp.SessionID(cookie), sessions[0].ID)
+		assert.Equal("Firefox", sessions[0].UserAgent)
+	}
+
+	assert.NoError(s.DeleteSession("alice@example.com", pp.SessionID(cookie)))
+	_, ok, err = s.SessionUser(cookie, time.Hour)
+	assert.NoError(err)
+	assert.False(ok)
+}
@@ -0,0 +1,91 @@
+package pp
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// Transcript is a transcript (or captions) of an episode, a file next to the
+// episode with one of transcriptTypes as the suffix of its key.
+type Transcript struct {
+	// Key is the key of the transcript in the backend (relative to the
+	// prefix, like the logo), it's served by GetFile
+	Key string
+	// ContentType is text/vtt, application/x-subrip or text/plain
+	ContentType string
+}
+
+// Format returns the format of the transcript: vtt, srt or txt.
+func (t Transcript) Format() string {
+	return t.Key[strings.LastIndex(t.Key, ".")+1:]
+}
+
+// transcriptTypes are the suffixes of the transcripts of an episode and their
+// content types. Plain text transcripts have their own suffix because
+// <key>.txt is the description of the episode.
+var transcriptTypes = []struct {
+	suffix      string
+	contentType string
+}{
+	{".vtt", "text/vtt"},
+	{".srt", "application/x-subrip"},
+	{".transcript.txt", "text/plain"},
+}
+
+// transcripts returns the transcripts of the episode with the given key, exists
+// is used to check which of them exist. The prefix is removed from the keys of
+// the transcripts.
+func transcripts(key, prefix string, exists func(string) bool) []Transcript {
+	var out []Transcript
+	for _, t := range transcriptTypes {
+		if exists(key + t.suffix) {
+			out = append(out, Transcript{strings.TrimPrefix(key+t.suffix, prefix), t.contentType})
+		}
+	}
+	return out
+}
+
+// transcriptPodcast returns the key of the episode of the transcript, or an
+// empty string if the key isn't a transcript.
+func transcriptPodcast(key string) string {
+	for _, t := range transcriptTypes {
+		if podcast := strings.TrimSuffix(key, t.suffix); podcast != key && isEpisode(podcast) {
+			return podcast
+		}
+	}
+	return ""
+}
+
+// srtTimestamp matches the timestamps of SRT, which use a comma before the
+// milliseconds where WebVTT uses a dot.
+var srtTimestamp = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// SRTToVTT converts SubRip captions to WebVTT, which is the only format
+// browsers support for <track>. The cue numbers of SRT are valid cue
+// identifiers in WebVTT, so only the header and the timestamps are changed.
+func SRTToVTT(srt []byte) []byte {
+	srt = bytes.TrimPrefix(srt, []byte("\xef\xbb\xbf"))
+	srt = bytes.Replace(srt, []byte("\r\n"), []byte("\n"), -1)
+
+	lines := bytes.Split(srt, []byte("\n"))
+	for i, line := range lines {
+		if bytes.Contains(line, []byte("-->")) {
+			lines[i] = srtTimestamp.ReplaceAll(line, []byte("$1.$2"))
+		}
+	}
+
+	return append([]byte("WEBVTT\n\n"), bytes.Join(lines, []byte("\n"))...)
+}
+
+// transcriptsVersion is the part of the version of an episode for its
+// transcripts, only which of them exist matters since they are served as is.
+func transcriptsVersion(key string, exists func(string) bool) string {
+	var v strings.Builder
+	for _, t := range transcriptTypes {
+		if exists(key + t.suffix) {
+			v.WriteString(t.suffix)
+		}
+	}
+	return v.String()
+}